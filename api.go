@@ -1,6 +1,7 @@
 package rnas
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"sync"
@@ -12,138 +13,209 @@ import (
 
 
 func (c *Config) Put(filepath string, _size int64, reader io.Reader) error {
+	return c.PutContext(context.Background(), filepath, _size, reader)
+}
+
+// PutContext is Put whose upload is aborted and rolled back once ctx is done
+func (c *Config) PutContext(ctx context.Context, filepath string, _size int64, reader io.Reader) error {
 	size := size_t(_size)
 	log.Infof("Put object to %s with size %d", filepath, size)
 	now := time.Now()
-	enc, err := reedsolomon.New(c.K, c.M)
-	if err != nil {
-		return err
-	} 
 
-	fs := &FileStripe{Size: size, ConfigName: c.Name, Filepath: filepath, StripeConfig: c.StripeConfig }
-	
-	n := fs.K + fs.M
-	// numDataShards := int((size + size_t(fs.StripeDepth) - 1) / size_t(fs.StripeDepth))
-	numStripes := int((size + size_t(fs.StripeDepth * fs.K) - 1) / size_t(fs.StripeDepth * fs.K))
-	// numShards := numStripes * n
+	fs := &FileStripe{Size: size, ConfigName: c.Name, Filepath: filepath, Chunked: c.Chunking != nil, StripeConfig: c.StripeConfig }
+
+	// an object whose content is already stored is not uploaded again
+	if seeker, ok := reader.(io.ReadSeeker); ok && c.Dedup {
+		hash, err := hashObject(seeker, _size)
+		if err != nil {
+			return fmt.Errorf("error while hashing the data: %v", err)
+		}
+		fs.ContentHash = hash
+		dup, err := c.putDuplicate(fs)
+		if err != nil {
+			return err
+		}
+		if dup {
+			end := time.Since(now)
+			log.Infof("%s has been put, took %v, speed %.2fB/s", filepath, end, float64(size) / float64(end.Seconds()))
+			return nil
+		}
+	}
 
-	err = saveFileStripe(fs)
+	p, err := c.beginPut(ctx, fs)
 	if err != nil {
 		return err
 	}
+	reader = p.reader(reader)
 
-	// log.Infof("- put object (%d shards) (%d stripes), size %d", numShards, numStripes, size)
+	if c.Chunking != nil {
+		err := p.putChunks(io.LimitReader(reader, _size))
+		if err == nil && fs.Size != size {
+			err = fmt.Errorf("error while reading the data: %v", io.ErrUnexpectedEOF)
+		}
+		if err != nil {
+			return p.rollback(err)
+		}
+		if err := p.commit(); err != nil {
+			return err
+		}
+		end := time.Since(now)
+		log.Infof("%s has been put, took %v, speed %.2fB/s", filepath, end, float64(size) / float64(end.Seconds()))
+		return nil
+	}
 
 	var done sync.WaitGroup
-	done.Add(numStripes)
+	// slots of the stripes in flight, reading waits for a free one
+	window := make(chan struct{}, c.maxInflightStripes())
 
-	log.Debug("numStripes:", numStripes)
+	for _, stripe := range fs.layout() {
+		select {
+		case window <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if p.failed() != nil {
+			break
+		}
+		log.Debugf("- handle stripe %d, shard size: %d", stripe.index, stripe.shardSize)
+
+		// room for the parity shards as well
+		buf := c.stripeBuffers.get(stripe.shardSize * (fs.K + fs.M))
+		_, err := io.ReadFull(reader, buf[:stripe.size])
+		if err != nil {
+			done.Wait()
+			return p.rollback(fmt.Errorf("error while reading the data: %v", err))
+		}
+		// zero the padding
+		clear(buf[stripe.size:stripe.shardSize * fs.K])
 
-	stripeIndex := 0
-	for i := size_t(0); i < size; stripeIndex++{
-		left := size - i
-		shardSize := max(min(fs.StripeDepth, int(left / size_t(fs.K))), c.MinDepth)
-		// stripeWidth := shardSize * n
-		i += size_t(shardSize) * size_t(fs.K)
-		log.Debugf("- handle stripe %d, shard size: %d", stripeIndex, shardSize)
-
-
-		shards := make([]Shard, n)
-		data := make([][]byte, n)
-
-		// init shards and data
-		for j := 0; j < n; j++ {
-			data[j] = make([]byte, shardSize)
-			shards[j] = Shard{
-				fileID: fs.ID,
-				shardIndex: stripeIndex * n + j,
-				serverID: c.slots[j],
+		// encode and send stripe
+		done.Add(1)
+		go func(stripeIndex int, buf []byte, data [][]byte) {
+			err := p.putStripe(stripeIndex, data)
+			if err == nil {
+				// a failed put may still be sending the buffer
+				c.stripeBuffers.put(buf)
 			}
+			<-window
+			done.Done()
+		}(stripe.index, buf, c.splitStripe(buf, stripe.shardSize))
+	}
+
+	done.Wait()
+	if err := p.failed(); err != nil {
+		return p.rollback(err)
+	}
+	if err := p.commit(); err != nil {
+		return err
+	}
+	end := time.Since(now)
+	log.Infof("%s has been put, took %v, speed %.2fB/s", filepath, end, float64(size) / float64(end.Seconds()))
+	return nil
+}
+
+// PutStream puts an object whose size is unknown in advance, such as stdin
+// or a pipe. At most one stripe is buffered, the final size is written
+// when the stream ends.
+func (c *Config) PutStream(filepath string, reader io.Reader) error {
+	return c.PutStreamContext(context.Background(), filepath, reader)
+}
+
+// PutStreamContext is PutStream whose upload is aborted and rolled back
+// once ctx is done
+func (c *Config) PutStreamContext(ctx context.Context, filepath string, reader io.Reader) error {
+	log.Infof("Put object stream to %s", filepath)
+	now := time.Now()
+
+	fs := &FileStripe{ConfigName: c.Name, Filepath: filepath, Chunked: c.Chunking != nil, StripeConfig: c.StripeConfig}
+
+	p, err := c.beginPut(ctx, fs)
+	if err != nil {
+		return err
+	}
+	reader = p.reader(reader)
+
+	if c.Chunking != nil {
+		err := p.putChunks(reader)
+		if err != nil {
+			return p.rollback(err)
+		}
+		if err := p.commit(); err != nil {
+			return err
 		}
+		end := time.Since(now)
+		log.Infof("%s has been put, took %v, speed %.2fB/s", filepath, end, float64(fs.Size) / float64(end.Seconds()))
+		return nil
+	}
 
-		// copy data
-		for j := 0; j < fs.K; j++ {
-			shards[j].dataShard = true
-			n, err := reader.Read(data[j])
-			if n > 0  && n < len(data[j]) {
-				break
-			}
-			if err != nil {
-				//todo goto err
-				return fmt.Errorf("error while reading the data: %v", err)
-			}
+	stripeIndex := 0
+	for eof := false; !eof; {
+		buf := make([]byte, fs.shardSize(size_t(fs.StripeDepth * fs.K)) * fs.K)
+		read, err := io.ReadFull(reader, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			eof = true
+		} else if err != nil {
+			return p.rollback(fmt.Errorf("error while reading the data: %v", err))
 		}
 
-		// encode and send stripe
-		go func(data [][]byte, shards []Shard) {
-			// encode
-			log.Debug("- start to encode stripe")
-			now := time.Now()
-			err := enc.Encode(data)
-			end := time.Since(now)
-			
-			if err != nil {
-				log.Fatal("bad encoding:", err)
+		// cut the data read the same way as the layout of Put
+		for i := 0; i < read; stripeIndex++ {
+			left := read - i
+			shardSize := fs.shardSize(size_t(left))
+			log.Debugf("- handle stripe %d, shard size: %d", stripeIndex, shardSize)
+
+			width := shardSize * fs.K
+			stripe := buf[i:min(i + width, read)]
+			if len(stripe) < width {
+				// pad the last stripe
+				stripe = append(make([]byte, 0, width), stripe...)[:width]
 			}
 
-			log.Debugf("- encode stripe cost %v", end)
-
-			var wg sync.WaitGroup
-			wg.Add(n)
-
-			// send
-			for i := 0; i < n; i++ {
-				shard := &shards[i]
-				shard.shardHashname = hashMD5(data[i])
-				server := c.maps[shards[i].serverID]
-
-				go func(shard *Shard, data []byte) {
-					err := server.PutShard(shard, data);
-					if err != nil {
-						log.Errorf("error when put shard to server[%s]: %v", server.Id, err)
-					} else {
-						err := saveShard(shard)
-						if err != nil {
-							log.Errorf("saveShard error: %v", err)
-						}
-					}
-					wg.Done()
-					
-				}(shard, data[i])
+			err := p.putStripe(stripeIndex, c.splitStripe(stripe, shardSize))
+			if err != nil {
+				return p.rollback(err)
 			}
-			wg.Wait()
-			done.Done()
-		}(data, shards)
+			i += width
+		}
+		fs.Size += size_t(read)
+	}
 
+	if err := p.commit(); err != nil {
+		return err
 	}
 
-	done.Wait()
 	end := time.Since(now)
-	fmt.Printf("%s has been put, took %v, speed %.2fB/s\n", filepath, end, float64(size) / float64(end.Seconds()))
+	log.Infof("%s has been put, took %v, speed %.2fB/s", filepath, end, float64(fs.Size) / float64(end.Seconds()))
 	return nil
 }
 
-
-
 type StripeData struct {
 	size int
 	data [][]byte
 	err error
 }
 
-type ShardData struct {
-	data []byte
-	shard *Shard
+// ReadStream reads the object as a stream. The reader must be closed, which
+// stops the reads of the stripes left when the stream is not read through.
+func (c *Config) ReadStream(filepath string) (io.ReadCloser, error) {
+	return c.ReadStreamContext(context.Background(), filepath)
 }
 
-func (c *Config) ReadStream(filepath string) (io.Reader, error) {
+// ReadStreamContext is ReadStream whose shard reads are cancelled once ctx
+// is done, the reader then fails with the error of ctx. Closing the reader
+// early cancels the reads as well.
+func (c *Config) ReadStreamContext(ctx context.Context, filepath string) (io.ReadCloser, error) {
 	log.Infof("Get object from %s", filepath)
 
-	fs, err := getFileStripe(filepath)
+	fs, err := c.getObject(filepath)
 	if err != nil {
 		return nil,err
 	}
 
+	err = c.loadObjectCipher(fs)
+	if err != nil {
+		return nil, err
+	}
+
 	allShards, err := getShards(fs.ID)
 	if err != nil {
 		return nil, err
@@ -152,7 +224,7 @@ func (c *Config) ReadStream(filepath string) (io.Reader, error) {
 	n := fs.K + fs.M
 	numShards := len(allShards)
 
-	if numShards % n != 0 {
+	if numShards != len(fs.layout()) * n {
 		return nil, fmt.Errorf("bad shards number: %d", numShards)
 	}
 	
@@ -164,22 +236,38 @@ func (c *Config) ReadStream(filepath string) (io.Reader, error) {
 
 	log.Infof("- get object = (%d shards) = %d stripes, size %d", numStripes * n, numStripes, fs.Size)
 
-	var data sync.Map
+	enc, err := reedsolomon.New(fs.K, fs.M)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
 	pr, pw := io.Pipe()
+	// the stripes in flight in order, each one delivered by its own channel.
+	// Fetching a stripe waits for a free slot, so at most
+	// maxInflightStripes stripes are fetched or buffered.
+	pending := make(chan chan StripeData, c.maxInflightStripes() - 1)
+
+	// unblock the writer once ctx is done
+	go func() {
+		<-ctx.Done()
+		pw.CloseWithError(ctx.Err())
+	}()
 
 	// check data and send them to receiver 
 	go func() {
-		for i := 0; i < numStripes; i++ {
+		// stop fetching stripes when the writer is gone
+		defer cancel()
+
+		i := 0
+		for result := range pending {
 			var stripe StripeData
 
 			log.Debugf("- waiting for stripe %d", i)
-			for {
-				v, ok := data.Load(i)
-				if ok {
-					stripe = v.(StripeData)
-					break
-				}
-				time.Sleep(time.Millisecond)
+			select {
+			case stripe = <-result:
+			case <-ctx.Done():
+				return
 			}
 
 			if stripe.err != nil {
@@ -194,123 +282,53 @@ func (c *Config) ReadStream(filepath string) (io.Reader, error) {
 					break
 				}
 				size := min(len(data), stripe.size - written)
-				pw.Write(data[:size])
+				if _, err := pw.Write(data[:size]); err != nil {
+					// the reader is closed
+					return
+				}
 				written += size
 			}
 			log.Debugf("- read %d bytes from stripe %d", written, i)
+
+			for _, shard := range stripe.data {
+				c.shardBuffers.put(shard)
+			}
+			i++
 		}
 
+		// stripes are no longer fetched once ctx is done
+		if err := ctx.Err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
 		pw.Close()
 	}()
 
-	stripeIndex := 0
-	// get stripes
-	for i := size_t(0); i < fs.Size; stripeIndex++ {
-		left := fs.Size - i
-		shardSize := max(min(fs.StripeDepth, int(left / size_t(fs.K))), c.MinDepth)
-		dataChan := make(chan ShardData, n)
-		log.Debugf("- start to retrieve stripe %d, shard size: %d", stripeIndex, shardSize)
-		i += size_t(shardSize) * size_t(fs.K)
-
-
-		// get shards
-		for j := 0; j < n; j++ {
-			shard := &allShards[j + stripeIndex * n]
-			server, ok := c.maps[shard.serverID]
-
-			if !ok {
-				// server not exists, may be removed?
-				log.Warnf("server[%s] doesn't exist. skip", shard.serverID)
-				dataChan <- ShardData{nil, shard}
-				continue
-			}
-
-			// get shard
-			go func(shard *Shard, shardSize int) {
-				data := make([]byte, shardSize)
-				_, err := server.GetShard(shard, data);
-
-				if err != nil {
-					log.Warnf("retrieve shard %d error: %v", shard.shardIndex, err)
-					dataChan <- ShardData{nil, shard}
-				} else {
-					if hashMD5(data) != shard.shardHashname {
-						log.Fatalf("bad data when verifying shard %d: %s", shard.shardIndex, shard.shardHashname)
-					} else {
-						log.Debugf("shard %d verified pass", shard.shardIndex)
-					}
-					dataChan <- ShardData{data, shard}
-				}
-			}(shard, shardSize)
+	fetch := func(stripe stripeLayout, result chan<- StripeData) {
+		shards := allShards[stripe.index * n : (stripe.index + 1) * n]
+		validStripe, err := c.readStripeHedged(ctx, enc, fs, shards, stripe.shardSize)
+		if err != nil {
+			result <- StripeData{err: fmt.Errorf("stripe %d has left us permanently: %w", stripe.index, err)}
+			return
 		}
+		log.Infof("- got all shards for stripe %d", stripe.index)
+		result <- StripeData{size: int(stripe.size), data: validStripe}
+	}
 
-		go func(stripeIndex int, shardSize int, left size_t) {
-			stripe := make([][]byte, n)
-			received := 0
-			dataReceived := 0
-			validReceived := 0
-			resultChan := make(chan [][]byte, 3)
-			done := false
-			var fixStatus chan bool
-
-			for !done {
-				// cannot fix
-				if received == n && (fixStatus == nil || !<- fixStatus) {
-					break
-				}
-
-				select {
-				case v := <- dataChan:
-					received++
-					if v.data != nil {
-						validReceived++
-						if v.shard.dataShard {
-							dataReceived++
-						}
-						stripe[v.shard.shardIndex - stripeIndex * n] = v.data
-					}
-					// receive all data
-					if dataReceived == fs.K {
-						resultChan <- stripe
-					}
-					// only triggered once
-					if validReceived == fs.K && dataReceived < fs.K && fixStatus == nil {
-						fixStatus = make(chan bool)
-						copyStripe := make([][]byte, n)
-						copy(copyStripe, stripe)
-						// fix goroutine
-						go func(data [][]byte) {
-							log.Info("- got enough shards, begin to restore data in parallel")
-							enc, err := reedsolomon.New(c.K, c.M)
-							if err != nil {
-								log.Error("failed to init decoder")
-								fixStatus <- false
-								return
-							} 
-							err = enc.ReconstructData(data)
-							if err != nil {
-								log.Error("failed to restore data")
-								fixStatus <- false
-								return
-							} 
-							log.Info("- fix done")
-							fixStatus <- true
-							resultChan <- data
-						}(copyStripe)
-					}
-				case validStripe := <-resultChan:
-					log.Infof("- got all shards for stripe %d", stripeIndex)
-					done = true
-					size :=  min(left, size_t(shardSize * fs.K))
-					data.Store(stripeIndex, StripeData{size:int(size), data: validStripe[:fs.K]})
-				}
-			}
-
-			if !done {
-				data.Store(stripeIndex, StripeData{err: fmt.Errorf("stripe %d has left us permanently", stripeIndex)})
+	// get stripes
+	go func() {
+		defer close(pending)
+		for _, stripe := range fs.layout() {
+			result := make(chan StripeData, 1)
+			select {
+			case pending <- result:
+			case <-ctx.Done():
+				return
 			}
-		}(stripeIndex, shardSize, left)
-	}
+			log.Debugf("- start to retrieve stripe %d, shard size: %d", stripe.index, stripe.shardSize)
+			go fetch(stripe, result)
+		}
+	}()
 
 	return pr,nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,25 @@
+package rnas
+
+import "sync"
+
+// bufferPool reuses buffers, which are mostly of the same size as the
+// stripes of an object share one shard size except the last one
+type bufferPool struct {
+	pool sync.Pool
+}
+
+// get returns a buffer of the size, whose content is undefined
+func (p *bufferPool) get(size int) []byte {
+	if b, ok := p.pool.Get().(*[]byte); ok && cap(*b) >= size {
+		return (*b)[:size]
+	}
+	return make([]byte, size)
+}
+
+// put gives back a buffer, which must not be used anymore
+func (p *bufferPool) put(b []byte) {
+	if cap(b) == 0 {
+		return
+	}
+	p.pool.Put(&b)
+}
@@ -0,0 +1,276 @@
+package rnas
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const defaultAvgChunkSize = 1 << 20
+
+// ChunkingConfig enables content-defined chunking. Objects are cut into
+// chunks where their content matches a pattern (FastCDC), so inserting or
+// removing bytes only changes the chunks around, and every chunk is striped
+// on its own. A chunk already stored is not uploaded again.
+type ChunkingConfig struct {
+	MinSize int `json:"minSize,omitempty"`
+	AvgSize int `json:"avgSize,omitempty"`
+	MaxSize int `json:"maxSize,omitempty"`
+}
+
+// validate fills the default sizes, which are saved along with the config
+// as changing them moves every chunk boundary
+func (cc *ChunkingConfig) validate() error {
+	if cc.AvgSize == 0 {
+		cc.AvgSize = defaultAvgChunkSize
+	}
+	if cc.MinSize == 0 {
+		cc.MinSize = cc.AvgSize / 4
+	}
+	if cc.MaxSize == 0 {
+		cc.MaxSize = cc.AvgSize * 4
+	}
+	if cc.AvgSize < 256 {
+		return fmt.Errorf("avgSize of chunking must be at least 256, but avgSize = %d", cc.AvgSize)
+	}
+	if cc.MinSize <= 0 || cc.MinSize > cc.AvgSize || cc.AvgSize > cc.MaxSize {
+		return fmt.Errorf("chunking needs 0 < minSize <= avgSize <= maxSize, but %d, %d, %d", cc.MinSize, cc.AvgSize, cc.MaxSize)
+	}
+	return nil
+}
+
+// chunk is a stripe of a chunked object
+type chunk struct {
+	stripeLayout
+	hash string // SHA-256 of the data of the chunk
+}
+
+// gear maps every byte to a random value for the rolling hash. It is
+// generated from a fixed seed, as the chunk boundaries must never change.
+var gear = func() (table [256]uint64) {
+	state := uint64(0x726e6173)
+	for i := range table {
+		// splitmix64
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return
+}()
+
+// chunker cuts a stream into chunks by content
+type chunker struct {
+	r    io.Reader
+	buf  []byte // holds up to a chunk of max size
+	n    int    // bytes buffered
+	last int    // size of the chunk returned last, dropped on the next call
+	eof  bool
+
+	min, avg, max int
+	// a cut point is where the masked bits of the hash are zero, harder to
+	// find before the average size and easier after
+	maskS, maskL uint64
+}
+
+func newChunker(r io.Reader, cc *ChunkingConfig) *chunker {
+	level := bits.Len(uint(cc.AvgSize)) - 1
+	return &chunker{
+		r:     r,
+		buf:   make([]byte, cc.MaxSize),
+		min:   cc.MinSize,
+		avg:   cc.AvgSize,
+		max:   cc.MaxSize,
+		maskS: ^uint64(0) << (64 - (level + 2)),
+		maskL: ^uint64(0) << (64 - (level - 2)),
+	}
+}
+
+// next returns the next chunk, which is only valid until the next call,
+// or io.EOF at the end of the stream
+func (ch *chunker) next() ([]byte, error) {
+	copy(ch.buf, ch.buf[ch.last:ch.n])
+	ch.n -= ch.last
+	ch.last = 0
+
+	if !ch.eof && ch.n < len(ch.buf) {
+		read, err := io.ReadFull(ch.r, ch.buf[ch.n:])
+		ch.n += read
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			ch.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if ch.n == 0 {
+		return nil, io.EOF
+	}
+
+	ch.last = ch.cut(ch.buf[:ch.n])
+	return ch.buf[:ch.last], nil
+}
+
+// cut returns the size of the chunk at the head of data, which is shorter
+// than the max size only at the end of the stream
+func (ch *chunker) cut(data []byte) int {
+	if len(data) <= ch.min {
+		return len(data)
+	}
+	end := min(len(data), ch.max)
+	normal := min(ch.avg, end)
+
+	var fp uint64
+	i := ch.min
+	for ; i < normal; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&ch.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < end; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&ch.maskL == 0 {
+			return i + 1
+		}
+	}
+	return end
+}
+
+// putChunks cuts the object into chunks by content and puts every chunk as
+// a stripe. A chunk already stored with the same key is referred to instead
+// of uploaded again. The size and the chunk index are written on commit,
+// once the object is read through.
+func (p *putSession) putChunks(reader io.Reader) error {
+	c, fs := p.c, p.fs
+	fs.Size = 0
+	fs.chunks = nil
+
+	chunker := newChunker(reader, c.Chunking)
+	reused := 0
+
+	var done sync.WaitGroup
+	// slots of the stripes in flight, reading waits for a free one
+	window := make(chan struct{}, c.maxInflightStripes())
+
+	var err error
+	for index := 0; ; index++ {
+		select {
+		case window <- struct{}{}:
+		case <-p.ctx.Done():
+		}
+		if p.failed() != nil {
+			break
+		}
+
+		var data []byte
+		data, err = chunker.next()
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			err = fmt.Errorf("error while reading the data: %v", err)
+			break
+		}
+
+		ch := chunk{
+			stripeLayout: stripeLayout{
+				index:     index,
+				offset:    fs.Size,
+				size:      size_t(len(data)),
+				shardSize: max((len(data)+fs.K-1)/fs.K, 1),
+			},
+			hash: hashSHA256(data),
+		}
+		fs.chunks = append(fs.chunks, ch)
+		fs.Size += ch.size
+
+		var ok bool
+		ok, err = p.reuseChunk(&ch)
+		if err != nil {
+			break
+		}
+		if ok {
+			log.Debugf("- chunk %d of size %d is already stored", index, ch.size)
+			reused++
+			<-window
+			continue
+		}
+		log.Debugf("- handle chunk %d of size %d, shard size: %d", index, ch.size, ch.shardSize)
+
+		// room for the parity shards as well
+		buf := c.stripeBuffers.get(ch.shardSize * (fs.K + fs.M))
+		copy(buf, data)
+		// zero the padding
+		clear(buf[len(data) : ch.shardSize*fs.K])
+
+		// encode and send stripe
+		done.Add(1)
+		go func(stripeIndex int, buf []byte, data [][]byte) {
+			err := p.putStripe(stripeIndex, data)
+			if err == nil {
+				// a failed put may still be sending the buffer
+				c.stripeBuffers.put(buf)
+			}
+			<-window
+			done.Done()
+		}(index, buf, c.splitStripe(buf, ch.shardSize))
+	}
+
+	done.Wait()
+	if err != nil {
+		return err
+	}
+	if err := p.failed(); err != nil {
+		return err
+	}
+
+	log.Infof("- %d chunks, %d already stored", len(fs.chunks), reused)
+	return nil
+}
+
+// reuseChunk refers to the shards of a stored chunk of the same content,
+// striped and sealed in the same way. It returns false when there is none.
+func (p *putSession) reuseChunk(ch *chunk) (bool, error) {
+	fs := p.fs
+	n := fs.K + fs.M
+
+	shards, err := getChunkShards(fs.ConfigName, ch.hash, fs.K, fs.M, fs.WrappedKey)
+	if err != nil || len(shards) != n {
+		return false, err
+	}
+	for j := range shards {
+		if shards[j].contentHash == "" || shards[j].missing || shards[j].size != fs.storedShardSize(ch.shardSize) {
+			return false, nil
+		}
+	}
+	ok, err := p.c.pinStoredShards(shards)
+	if !ok {
+		return false, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned = append(p.pinned, shards...)
+	for j := range shards {
+		shards[j].fileID = fs.ID
+		shards[j].shardIndex = ch.index*n + j
+	}
+	p.shards = append(p.shards, shards...)
+	return true, nil
+}
+
+// inheritObjectCipher seals the new version of an object with the key of
+// the stored one, so that its unchanged chunks are sealed to the same bytes
+// and reused
+func (c *Config) inheritObjectCipher(fs *FileStripe, prev *FileStripe) error {
+	fs.WrappedKey = prev.WrappedKey
+	if err := c.loadObjectCipher(fs); err != nil {
+		return fmt.Errorf("failed to inherit the key of %s: %w", fs.Filepath, err)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package rnas
 
 import (
+	"fmt"
 	"sort"
 
 	log "github.com/sirupsen/logrus"
@@ -8,6 +9,8 @@ import (
 
 type size_t int64
 
+const defaultInflightStripes = 8
+
 type StripeConfig struct {
 	K           int `json:"K"`
 	M           int `json:"M"`
@@ -21,8 +24,18 @@ type FileStripe struct {
 	// RealSize		size_t
 	ConfigName 		string
 	Filepath 		string
+	WrappedKey		[]byte
+	// flagged by fsck, cleared once scrubbed clean
+	NeedsRepair		bool
+	// SHA-256 of the object, only recorded in dedup mode
+	ContentHash		string
+	// cut into chunks by content, whose layout is stored in the chunk index
+	Chunked			bool
 
 	StripeConfig
+
+	cipher *shardCipher
+	chunks []chunk
 }
 
 type Shard struct {
@@ -32,6 +45,11 @@ type Shard struct {
 	shardHashname string
 	dataShard	bool
 	size 		int
+	// SHA-256 of the stored shard in dedup mode, the shard then lives in
+	// the content-addressed store shared by all objects
+	contentHash	string
+	// failed to be stored by the put, recovered by scrub
+	missing		bool
 
 	// StripeConfig
 }
@@ -42,24 +60,77 @@ type Config struct {
 	Name 		string `json:"name"`
 	Tolerance   int `json:"tolerance"`
 	Servers     []*Server `json:"servers"`
+	Encryption  *EncryptionConfig `json:"encryption,omitempty"`
+	// WriteQuorum is the min number of shards of every stripe that must be
+	// stored for a put to succeed, K + M when zero
+	WriteQuorum int `json:"writeQuorum,omitempty"`
+	// MaxInflightStripes bounds the stripes buffered by a put or a read,
+	// defaultInflightStripes when zero
+	MaxInflightStripes int `json:"maxInflightStripes,omitempty"`
+	// Dedup stores shards by content so that identical shards and objects
+	// are stored once and shared
+	Dedup bool `json:"dedup,omitempty"`
+	// Chunking cuts objects into chunks by content, so that a new version
+	// only uploads the chunks changed, it needs Dedup
+	Chunking *ChunkingConfig `json:"chunking,omitempty"`
 	
 	StripeConfig
 
+	// OnShardError is called when a server serves a corrupt shard, which is
+	// then recovered from the other shards. It may be called concurrently.
+	OnShardError func(err *ShardError) `json:"-"`
+
+	masterKey []byte
+	stripeBuffers *bufferPool
+	shardBuffers *bufferPool
 	maps map[string]*Server
 	slots	[]string
 	dryrun bool
+	cas *casPins
 }
 
-func(c *Config) Init() {
+func(c *Config) Init() error {
 	log.Info("Config initializing...")
 	if c.K + c.M > len(c.Servers) {
-		log.Fatalf("need k + m <= servers, but %d + %d > %d", c.K, c.M, len(c.Servers))
+		return fmt.Errorf("%w: need k + m <= servers, but %d + %d > %d", ErrNotEnoughServers, c.K, c.M, len(c.Servers))
+	}
+
+	if c.Tolerance < 1 || c.Tolerance > c.M {
+		return fmt.Errorf("%w: need 1 <= tolerance <= M, but tolerance = %d, M = %d", ErrInvalidConfig, c.Tolerance, c.M)
+	}
+
+	if c.WriteQuorum != 0 && (c.WriteQuorum < c.K + c.Tolerance || c.WriteQuorum > c.K + c.M) {
+		return fmt.Errorf("%w: need K + tolerance <= writeQuorum <= K + M, but writeQuorum = %d", ErrInvalidConfig, c.WriteQuorum)
 	}
 
-	if c.Tolerance > c.M {
-		log.Fatalf("need tolerrance <= M, but %d > %d", c.Tolerance, c.M)
+	if c.MaxInflightStripes < 0 {
+		return fmt.Errorf("%w: maxInflightStripes = %d is negative", ErrInvalidConfig, c.MaxInflightStripes)
+	}
+
+	if c.Chunking != nil {
+		if !c.Dedup {
+			return fmt.Errorf("%w: chunking needs dedup", ErrInvalidConfig)
+		}
+		if err := c.Chunking.validate(); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+	}
+
+	if c.Encryption != nil {
+		log.Info("- init encryption")
+		err := c.Encryption.validate()
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidConfig, err)
+		}
+		c.masterKey, err = c.Encryption.masterKey()
+		if err != nil {
+			return fmt.Errorf("failed to derive master key, because: %w", err)
+		}
 	}
 
+	c.stripeBuffers = &bufferPool{}
+	c.shardBuffers = &bufferPool{}
+	c.cas = &casPins{pins: make(map[string]int)}
 	c.maps = make(map[string]*Server)
 	c.slots = make([]string, c.K + c.M)
 
@@ -69,26 +140,48 @@ func(c *Config) Init() {
 
 		_, ok := c.maps[server.Id]
 		if ok {
-			log.Fatalf("Duplicated id: %s", server.Id)
+			return fmt.Errorf("%w: %s", ErrDuplicateServerID, server.Id)
 		}
 
 		if c.dryrun {
 			server.Type = "dryrun"
 		}
 		
-		server.Init(c)
+		err := server.Init(c)
+		if err != nil {
+			return err
+		}
 
 		c.maps[server.Id] = server
 	}
 
 	log.Info("- schedule slots")
-	c.ScheduleSlots()
+	err := c.ScheduleSlots()
+	if err != nil {
+		return err
+	}
 	log.Info("Init Done")
+	return nil
 }
 
 
+// writeQuorum returns the min number of shards of a stripe to store
+func (c *Config) writeQuorum() int {
+	if c.WriteQuorum == 0 {
+		return c.K + c.M
+	}
+	return c.WriteQuorum
+}
 
-func(c *Config) ScheduleSlots() {
+// maxInflightStripes returns the max number of stripes in flight
+func (c *Config) maxInflightStripes() int {
+	if c.MaxInflightStripes == 0 {
+		return defaultInflightStripes
+	}
+	return c.MaxInflightStripes
+}
+
+func(c *Config) ScheduleSlots() error {
 	log.Info("- start to schedule shard slots")
 
 	freeSlots := c.M / c.Tolerance - 1
@@ -113,16 +206,20 @@ func(c *Config) ScheduleSlots() {
 	}
 
 	if nextSlotIndex != len(c.slots) {
-		log.Fatalf("unenough servers. At least K + M - freeSlots = %d", c.K + c.M - (c.M / c.Tolerance - 1))
+		return fmt.Errorf("%w: at least K + M - freeSlots = %d reachable servers are needed", ErrNotEnoughServers, c.K + c.M - (c.M / c.Tolerance - 1))
 	}
 
 	log.Infof("- slots alloc: %v", c.slots)
-
+	return nil
 }
 
-func(c *Config) TestAll() {
+func(c *Config) TestAll() error {
 	for i := range c.Servers {
 		server := c.Servers[i]
+		if !server.reachable {
+			log.Infof("Skip testing speed for unreachable %s", server.Id)
+			continue
+		}
 
 		log.Infof("Start to test speed for %s", server.Id)
 		err := server.TestSpeed()
@@ -132,7 +229,9 @@ func(c *Config) TestAll() {
 		}
 		log.Infof("- Result: ↑ %.2fB/s ↓ %.2fB/s", server.UploadBandwidth, server.DownloadBandwidth)
 	}
-	c.ScheduleSlots()
-	SaveConfigToDB(c)
+	err := c.ScheduleSlots()
+	if err != nil {
+		return err
+	}
+	return SaveConfigToDB(c)
 }
-
@@ -0,0 +1,228 @@
+package rnas
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	AlgAES256GCM         = "aes-256-gcm"
+	AlgXChaCha20Poly1305 = "xchacha20-poly1305"
+)
+
+const keySize = 32
+
+// EncryptionConfig enables client-side encryption of shards.
+//
+// Every object is encrypted with its own data key, which is wrapped by
+// the master key and stored along with the object. The master key is
+// derived from a passphrase read from an environment variable or from
+// the content of a key file, none of them is stored.
+type EncryptionConfig struct {
+	Algorithm     string `json:"algorithm,omitempty"`
+	PassphraseEnv string `json:"passphraseEnv,omitempty"`
+	KeyFile       string `json:"keyFile,omitempty"`
+	Salt          string `json:"salt,omitempty"`
+	KeyCheck      string `json:"keyCheck,omitempty"`
+}
+
+func (e *EncryptionConfig) validate() error {
+	if e.Algorithm == "" {
+		e.Algorithm = AlgAES256GCM
+	}
+	if e.Algorithm != AlgAES256GCM && e.Algorithm != AlgXChaCha20Poly1305 {
+		return fmt.Errorf("unsupported encryption algorithm: %s", e.Algorithm)
+	}
+	if e.PassphraseEnv == "" && e.KeyFile == "" {
+		return errors.New("encryption needs a key source, set passphraseEnv or keyFile")
+	}
+	if e.PassphraseEnv != "" && e.KeyFile != "" {
+		return errors.New("encryption needs only one key source, but both passphraseEnv and keyFile are set")
+	}
+	return nil
+}
+
+// masterKey derives the master key from the key source.
+// A new salt and key check are generated for a new config.
+func (e *EncryptionConfig) masterKey() ([]byte, error) {
+	var secret []byte
+	if e.PassphraseEnv != "" {
+		secret = []byte(os.Getenv(e.PassphraseEnv))
+		if len(secret) == 0 {
+			return nil, fmt.Errorf("passphrase environment variable %s is empty", e.PassphraseEnv)
+		}
+	} else {
+		data, err := os.ReadFile(e.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("key file %s is empty", e.KeyFile)
+		}
+		secret = data
+	}
+
+	if e.Salt == "" {
+		e.Salt = hex.EncodeToString(generateRandomData(16))
+	}
+	salt, err := hex.DecodeString(e.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("bad salt: %v", err)
+	}
+
+	key, err := scrypt.Key(secret, salt, 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	check := hex.EncodeToString(hmacSHA256(key, []byte("rnas key check"))[:8])
+	if e.KeyCheck == "" {
+		e.KeyCheck = check
+	} else if e.KeyCheck != check {
+		return nil, errors.New("wrong passphrase or key file")
+	}
+
+	return key, nil
+}
+
+func newAEAD(algorithm string, key []byte) (cipher.AEAD, error) {
+	switch algorithm {
+	case AlgAES256GCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case AlgXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	}
+	return nil, fmt.Errorf("unsupported encryption algorithm: %s", algorithm)
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// shardCipher encrypts the shards of one object.
+//
+// The nonce is derived from the data key and the plain shard, so the same
+// shard is always sealed to the same bytes. This keeps the hash name of a
+// rebuilt shard unchanged, and a nonce is never reused for different data.
+type shardCipher struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+func newShardCipher(algorithm string, dataKey []byte) (*shardCipher, error) {
+	aead, err := newAEAD(algorithm, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return &shardCipher{aead: aead, nonceKey: hmacSHA256(dataKey, []byte("rnas shard nonce"))}, nil
+}
+
+// overhead is the number of bytes a sealed shard is longer than the plain one
+func (sc *shardCipher) overhead() int {
+	return sc.aead.NonceSize() + sc.aead.Overhead()
+}
+
+// seal encrypts the shard into nonce || ciphertext
+func (sc *shardCipher) seal(data []byte) []byte {
+	nonce := hmacSHA256(sc.nonceKey, data)[:sc.aead.NonceSize()]
+	out := make([]byte, 0, len(data)+sc.overhead())
+	out = append(out, nonce...)
+	return sc.aead.Seal(out, nonce, data, nil)
+}
+
+// open decrypts and authenticates a sealed shard
+func (sc *shardCipher) open(data []byte) ([]byte, error) {
+	if len(data) < sc.overhead() {
+		return nil, errors.New("sealed shard is too short")
+	}
+	nonceSize := sc.aead.NonceSize()
+	return sc.aead.Open(nil, data[:nonceSize], data[nonceSize:], nil)
+}
+
+// newObjectCipher generates and wraps the data key of a new object
+func (c *Config) newObjectCipher(fs *FileStripe) error {
+	if c.Encryption == nil {
+		return nil
+	}
+
+	dataKey := generateRandomData(keySize)
+
+	wrapper, err := newAEAD(c.Encryption.Algorithm, c.masterKey)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, wrapper.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	fs.WrappedKey = wrapper.Seal(nonce, nonce, dataKey, []byte(fs.ConfigName))
+
+	fs.cipher, err = newShardCipher(c.Encryption.Algorithm, dataKey)
+	return err
+}
+
+// loadObjectCipher unwraps the data key of a stored object
+func (c *Config) loadObjectCipher(fs *FileStripe) error {
+	if fs.WrappedKey == nil {
+		return nil
+	}
+	if c.Encryption == nil || c.masterKey == nil {
+		return fmt.Errorf("%s is encrypted, but config %s has no encryption key", fs.Filepath, c.Name)
+	}
+
+	wrapper, err := newAEAD(c.Encryption.Algorithm, c.masterKey)
+	if err != nil {
+		return err
+	}
+	nonceSize := wrapper.NonceSize()
+	if len(fs.WrappedKey) < nonceSize {
+		return errors.New("bad wrapped key")
+	}
+	dataKey, err := wrapper.Open(nil, fs.WrappedKey[:nonceSize], fs.WrappedKey[nonceSize:], []byte(fs.ConfigName))
+	if err != nil {
+		return fmt.Errorf("failed to unwrap the key of %s: %v", fs.Filepath, err)
+	}
+
+	fs.cipher, err = newShardCipher(c.Encryption.Algorithm, dataKey)
+	return err
+}
+
+// sealShard returns the bytes to store for the plain shard
+func (fs *FileStripe) sealShard(data []byte) []byte {
+	if fs.cipher == nil {
+		return data
+	}
+	return fs.cipher.seal(data)
+}
+
+// openShard returns the plain shard of the stored bytes
+func (fs *FileStripe) openShard(data []byte) ([]byte, error) {
+	if fs.cipher == nil {
+		return data, nil
+	}
+	return fs.cipher.open(data)
+}
+
+// storedShardSize returns the size of a stored shard
+func (fs *FileStripe) storedShardSize(shardSize int) int {
+	if fs.cipher == nil {
+		return shardSize
+	}
+	return shardSize + fs.cipher.overhead()
+}
@@ -4,14 +4,17 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-
-	log "github.com/sirupsen/logrus"
 )
 
 var _db *sql.DB
 
+// dbExecer is satisfied by both *sql.DB and *sql.Tx
+type dbExecer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
 // Initialize the database tables
-func InitDB(db *sql.DB) {
+func InitDB(db *sql.DB) error {
 	// Create table if not exists
 	createConfigTableSQL := `
 	CREATE TABLE IF NOT EXISTS configs (
@@ -21,13 +24,13 @@ func InitDB(db *sql.DB) {
 	`
 	_, err := db.Exec(createConfigTableSQL)
 	if err != nil {
-		log.Fatal("failed to create table:", err)
+		return fmt.Errorf("failed to create table: %v", err)
 	}
 
 	// foreign key cascad
 	_, err = db.Exec("PRAGMA foreign_keys = ON")
 	if err != nil {
-		log.Fatal("Error enabling foreign keys:", err)
+		return fmt.Errorf("error enabling foreign keys: %v", err)
 	}
 
 
@@ -40,10 +43,29 @@ func InitDB(db *sql.DB) {
 		size INTEGER,
 		stripe_depth INTEGER,
 		min_depth INTEGER,
-		config_name TEXT
+		config_name TEXT,
+		wrapped_key BLOB,
+		needs_repair INTEGER DEFAULT 0,
+		content_hash TEXT,
+		chunked INTEGER DEFAULT 0
 	);`
 	if _, err := db.Exec(createFileStripesTable); err != nil {
-		log.Fatal("failed to create file_stripes table:", err)
+		return fmt.Errorf("failed to create file_stripes table: %v", err)
+	}
+	if err := addColumn(db, "file_stripes", "wrapped_key", "BLOB"); err != nil {
+		return fmt.Errorf("failed to migrate file_stripes table: %v", err)
+	}
+	if err := addColumn(db, "file_stripes", "needs_repair", "INTEGER DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to migrate file_stripes table: %v", err)
+	}
+	if err := addColumn(db, "file_stripes", "content_hash", "TEXT"); err != nil {
+		return fmt.Errorf("failed to migrate file_stripes table: %v", err)
+	}
+	if err := addColumn(db, "file_stripes", "chunked", "INTEGER DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to migrate file_stripes table: %v", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS file_stripes_content ON file_stripes(config_name, content_hash)`); err != nil {
+		return fmt.Errorf("failed to create file_stripes index: %v", err)
 	}
 
 	createShardsTable := `
@@ -55,22 +77,93 @@ func InitDB(db *sql.DB) {
 		server_id TEXT,
 		is_data_shard BOOLEAN,
 		shard_hashname TEXT,
+		content_hash TEXT,
+		missing INTEGER DEFAULT 0,
 		FOREIGN KEY (file_id) REFERENCES file_stripes(id) ON DELETE CASCADE,
 		UNIQUE(file_id, shard_index)
 	);`
 	if _, err := db.Exec(createShardsTable); err != nil {
-		log.Fatal("failed to create shards table:", err)
+		return fmt.Errorf("failed to create shards table: %v", err)
+	}
+	if err := addColumn(db, "shards", "content_hash", "TEXT"); err != nil {
+		return fmt.Errorf("failed to migrate shards table: %v", err)
+	}
+	if err := addColumn(db, "shards", "missing", "INTEGER DEFAULT 0"); err != nil {
+		return fmt.Errorf("failed to migrate shards table: %v", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS shards_content ON shards(server_id, content_hash)`); err != nil {
+		return fmt.Errorf("failed to create shards index: %v", err)
+	}
+
+	createChunksTable := `
+	CREATE TABLE IF NOT EXISTS chunks (
+		file_id INTEGER,
+		chunk_index INTEGER,
+		chunk_offset INTEGER,
+		size INTEGER,
+		shard_size INTEGER,
+		hash TEXT,
+		FOREIGN KEY (file_id) REFERENCES file_stripes(id) ON DELETE CASCADE,
+		PRIMARY KEY(file_id, chunk_index)
+	);`
+	if _, err := db.Exec(createChunksTable); err != nil {
+		return fmt.Errorf("failed to create chunks table: %v", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS chunks_hash ON chunks(hash)`); err != nil {
+		return fmt.Errorf("failed to create chunks index: %v", err)
+	}
+
+	createPendingDeletionsTable := `
+	CREATE TABLE IF NOT EXISTS pending_deletions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		config_name TEXT,
+		server_id TEXT,
+		path TEXT,
+		UNIQUE(server_id, path)
+	);`
+	if _, err := db.Exec(createPendingDeletionsTable); err != nil {
+		return fmt.Errorf("failed to create pending_deletions table: %v", err)
 	}
 
 	_db = db
+	return nil
 }
 
-// Save file stripe configuration to the database
-func saveFileStripe(file *FileStripe) error {
-	result, err := _db.Exec(
+// Add a column missing in a table created by an older version
+func addColumn(db *sql.DB, table, column, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, ctype string
+		var dflt sql.NullString
+		if err := rows.Scan(&cid, &name, &ctype, &notNull, &dflt, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Save file stripe configuration to the database, under its allocated ID
+// if any
+func saveFileStripe(db dbExecer, file *FileStripe) error {
+	result, err := db.Exec(
 		`INSERT OR REPLACE INTO file_stripes 
-		(filepath, k, m, config_name, size, stripe_depth, min_depth) VALUES (?, ?, ?, ?, ?, ?, ?)`,
-		file.Filepath, file.K, file.M, file.ConfigName, file.Size, file.StripeDepth, file.MinDepth)
+		(id, filepath, k, m, config_name, size, stripe_depth, min_depth, wrapped_key, needs_repair, content_hash, chunked) VALUES (NULLIF(?, 0), ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)`,
+		file.ID, file.Filepath, file.K, file.M, file.ConfigName, file.Size, file.StripeDepth, file.MinDepth, file.WrappedKey, file.NeedsRepair, file.ContentHash, file.Chunked)
 	if err != nil {
 		return fmt.Errorf("failed to insert file stripe config: %v", err)
 	}
@@ -85,34 +178,179 @@ func saveFileStripe(file *FileStripe) error {
 	return nil
 }
 
+// Allocate the ID of a file stripe saved once its shards are stored. The
+// ID is never handed out again, even if the file stripe is never saved, as
+// shards left under its directory may still be pending deletion.
+func allocFileStripeID() (int, error) {
+	tx, err := _db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`INSERT INTO sqlite_sequence (name, seq) SELECT 'file_stripes', 0
+		WHERE NOT EXISTS (SELECT 1 FROM sqlite_sequence WHERE name = 'file_stripes')`)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate file stripe id: %v", err)
+	}
+	var fileID int
+	err = tx.QueryRow(`UPDATE sqlite_sequence SET seq = seq + 1 WHERE name = 'file_stripes' RETURNING seq`).Scan(&fileID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to allocate file stripe id: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return fileID, nil
+}
+
+// Delete the file stripe at the path along with its shards and chunks in
+// the transaction saving the version replacing it. It returns the ID, 0 if
+// none, the config and the shards of the deleted one. Every statement
+// writes, so the version read is the one replaced even under concurrent
+// puts.
+func deleteFileStripeByPath(tx *sql.Tx, filepath string) (int, string, []Shard, error) {
+	rows, err := tx.Query(
+		`DELETE FROM shards WHERE file_id IN (SELECT id FROM file_stripes WHERE filepath = ?)
+		RETURNING file_id, shard_index, server_id, shard_hashname, is_data_shard, size, COALESCE(content_hash, ''), missing`, filepath)
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to delete shards: %v", err)
+	}
+	var shards []Shard
+	for rows.Next() {
+		shard := Shard{}
+		if err := rows.Scan(&shard.fileID, &shard.shardIndex, &shard.serverID, &shard.shardHashname, &shard.dataShard, &shard.size, &shard.contentHash, &shard.missing); err != nil {
+			rows.Close()
+			return 0, "", nil, fmt.Errorf("failed to scan shard row: %v", err)
+		}
+		shards = append(shards, shard)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, "", nil, fmt.Errorf("failed to delete shards: %v", err)
+	}
+
+	if _, err := tx.Exec(`DELETE FROM chunks WHERE file_id IN (SELECT id FROM file_stripes WHERE filepath = ?)`, filepath); err != nil {
+		return 0, "", nil, fmt.Errorf("failed to delete chunks: %v", err)
+	}
+
+	var fileID int
+	var configName string
+	err = tx.QueryRow(`DELETE FROM file_stripes WHERE filepath = ? RETURNING id, config_name`, filepath).Scan(&fileID, &configName)
+	if err == sql.ErrNoRows {
+		return 0, "", nil, nil
+	}
+	if err != nil {
+		return 0, "", nil, fmt.Errorf("failed to delete file stripe: %v", err)
+	}
+	return fileID, configName, shards, nil
+}
+
 func getFileStripe(filepath string) (*FileStripe, error) {
 	fs := &FileStripe{}
 	row := _db.QueryRow(
-		`SELECT id, k, m, config_name, size, stripe_depth, min_depth FROM file_stripes WHERE filepath = ?`, filepath)
-	err := row.Scan(&fs.ID, &fs.K, &fs.M, &fs.ConfigName, &fs.Size, &fs.StripeDepth, &fs.MinDepth)
+		`SELECT id, k, m, config_name, size, stripe_depth, min_depth, wrapped_key, needs_repair, COALESCE(content_hash, ''), chunked FROM file_stripes WHERE filepath = ?`, filepath)
+	err := row.Scan(&fs.ID, &fs.K, &fs.M, &fs.ConfigName, &fs.Size, &fs.StripeDepth, &fs.MinDepth, &fs.WrappedKey, &fs.NeedsRepair, &fs.ContentHash, &fs.Chunked)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file_strips: %w", err)
+	}
+	fs.Filepath = filepath
+
+	return fs, loadChunks(fs)
+}
+
+// prefixEnd returns the upper bound of the paths starting with the prefix.
+// Text is compared byte by byte, and 0xff never occurs in UTF-8.
+func prefixEnd(prefix string) string {
+	return prefix + "\xff"
+}
+
+// Read all file stripes belonging to the config whose filepath starts with the prefix
+func getFileStripes(configName, prefix string) ([]*FileStripe, error) {
+	rows, err := _db.Query(
+		`SELECT id, filepath, k, m, config_name, size, stripe_depth, min_depth, wrapped_key, needs_repair, COALESCE(content_hash, ''), chunked FROM file_stripes
+		WHERE config_name = ? AND filepath >= ? AND filepath < ? ORDER BY filepath`, configName, prefix, prefixEnd(prefix))
 	if err != nil {
-		return nil, fmt.Errorf("failed to query file_strips: %v", err)
+		return nil, fmt.Errorf("failed to query file_stripes: %v", err)
+	}
+	defer rows.Close()
+
+	var files []*FileStripe
+
+	for rows.Next() {
+		fs := &FileStripe{}
+		if err := rows.Scan(&fs.ID, &fs.Filepath, &fs.K, &fs.M, &fs.ConfigName, &fs.Size, &fs.StripeDepth, &fs.MinDepth, &fs.WrappedKey, &fs.NeedsRepair, &fs.ContentHash, &fs.Chunked); err != nil {
+			return nil, fmt.Errorf("failed to scan file_stripes row: %v", err)
+		}
+		files = append(files, fs)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
 	}
+	rows.Close()
 
-	return fs, nil
+	for _, fs := range files {
+		if err := loadChunks(fs); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
 }
 
 // Save shard information to the database
-func saveShard(shard *Shard) error {
-	_, err := _db.Exec(`INSERT INTO shards (file_id, shard_index, server_id, shard_hashname, is_data_shard, size) VALUES (?, ?, ?, ?, ?, ?)`,
-		shard.fileID, shard.shardIndex, shard.serverID, shard.shardHashname, shard.dataShard, shard.size)
+func saveShard(db dbExecer, shard *Shard) error {
+	_, err := db.Exec(`INSERT INTO shards (file_id, shard_index, server_id, shard_hashname, is_data_shard, size, content_hash, missing) VALUES (?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?)`,
+		shard.fileID, shard.shardIndex, shard.serverID, shard.shardHashname, shard.dataShard, shard.size, shard.contentHash, shard.missing)
 	if err != nil {
 		return fmt.Errorf("failed to insert shard info: %v", err)
 	}
 	return nil
 }
 
+// Flag a file stripe whose shards need to be repaired
+func setNeedsRepair(fileID int, needsRepair bool) error {
+	_, err := _db.Exec(`UPDATE file_stripes SET needs_repair = ? WHERE id = ?`, needsRepair, fileID)
+	if err != nil {
+		return fmt.Errorf("failed to update file stripe: %v", err)
+	}
+	return nil
+}
 
+// Delete a file stripe along with its shards
+func deleteFileStripe(fileID int) error {
+	tx, err := _db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM shards WHERE file_id = ?`, fileID); err != nil {
+		return fmt.Errorf("failed to delete shards: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM chunks WHERE file_id = ?`, fileID); err != nil {
+		return fmt.Errorf("failed to delete chunks: %v", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM file_stripes WHERE id = ?`, fileID); err != nil {
+		return fmt.Errorf("failed to delete file stripe: %v", err)
+	}
+
+	return tx.Commit()
+}
+
+// Move a shard to another server, or record it stored again
+func updateShardServer(db dbExecer, shard *Shard) error {
+	_, err := db.Exec(`UPDATE shards SET server_id = ?, missing = ? WHERE file_id = ? AND shard_index = ?`,
+		shard.serverID, shard.missing, shard.fileID, shard.shardIndex)
+	if err != nil {
+		return fmt.Errorf("failed to update shard info: %v", err)
+	}
+	return nil
+}
 
 // Read shard information by file ID
 func getShards(fileID int) ([]Shard, error) {
 
-	rows, err := _db.Query(`SELECT file_id, shard_index, server_id, shard_hashname, is_data_shard,size FROM shards WHERE file_id = ?`, fileID)
+	rows, err := _db.Query(`SELECT file_id, shard_index, server_id, shard_hashname, is_data_shard,size, COALESCE(content_hash, ''), missing FROM shards WHERE file_id = ? ORDER BY shard_index`, fileID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to query shards: %v", err)
 	}
@@ -122,7 +360,7 @@ func getShards(fileID int) ([]Shard, error) {
 
 	for rows.Next() {
 		shard := Shard{}
-		if err := rows.Scan(&shard.fileID, &shard.shardIndex, &shard.serverID, &shard.shardHashname, &shard.dataShard, &shard.size); err != nil {
+		if err := rows.Scan(&shard.fileID, &shard.shardIndex, &shard.serverID, &shard.shardHashname, &shard.dataShard, &shard.size, &shard.contentHash, &shard.missing); err != nil {
 			return nil, fmt.Errorf("failed to scan shard row: %v", err)
 		}
 		shards = append(shards, shard)
@@ -131,6 +369,182 @@ func getShards(fileID int) ([]Shard, error) {
 	return shards, nil
 }
 
+type pendingDeletion struct {
+	id       int
+	serverID string
+	path     string
+}
+
+// Record a path which failed to be deleted from a server
+func savePendingDeletion(db dbExecer, configName, serverID, path string) error {
+	_, err := db.Exec(`INSERT OR IGNORE INTO pending_deletions (config_name, server_id, path) VALUES (?, ?, ?)`,
+		configName, serverID, path)
+	if err != nil {
+		return fmt.Errorf("failed to insert pending deletion: %v", err)
+	}
+	return nil
+}
+
+// Read pending deletions of the config in the order they were recorded
+func getPendingDeletions(configName string) ([]pendingDeletion, error) {
+	rows, err := _db.Query(`SELECT id, server_id, path FROM pending_deletions WHERE config_name = ? ORDER BY id`, configName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query pending deletions: %v", err)
+	}
+	defer rows.Close()
+
+	var deletions []pendingDeletion
+
+	for rows.Next() {
+		d := pendingDeletion{}
+		if err := rows.Scan(&d.id, &d.serverID, &d.path); err != nil {
+			return nil, fmt.Errorf("failed to scan pending deletion row: %v", err)
+		}
+		deletions = append(deletions, d)
+	}
+
+	return deletions, rows.Err()
+}
+
+// Forget the pending deletion of a path which is written again
+func cancelPendingDeletion(db dbExecer, configName, serverID, path string) error {
+	_, err := db.Exec(`DELETE FROM pending_deletions WHERE config_name = ? AND server_id = ? AND path = ?`,
+		configName, serverID, path)
+	if err != nil {
+		return fmt.Errorf("failed to delete pending deletion: %v", err)
+	}
+	return nil
+}
+
+func removePendingDeletion(id int) error {
+	_, err := _db.Exec(`DELETE FROM pending_deletions WHERE id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("failed to delete pending deletion: %v", err)
+	}
+	return nil
+}
+
+// Read shard information of all file stripes belonging to the config
+// whose filepath starts with the prefix, grouped by file ID
+func getShardsByPrefix(configName, prefix string) (map[int][]Shard, error) {
+	rows, err := _db.Query(
+		`SELECT s.file_id, s.shard_index, s.server_id, s.shard_hashname, s.is_data_shard, s.size, COALESCE(s.content_hash, ''), s.missing FROM shards s
+		JOIN file_stripes f ON s.file_id = f.id
+		WHERE f.config_name = ? AND f.filepath >= ? AND f.filepath < ? ORDER BY s.file_id, s.shard_index`, configName, prefix, prefixEnd(prefix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shards: %v", err)
+	}
+	defer rows.Close()
+
+	shards := make(map[int][]Shard)
+
+	for rows.Next() {
+		shard := Shard{}
+		if err := rows.Scan(&shard.fileID, &shard.shardIndex, &shard.serverID, &shard.shardHashname, &shard.dataShard, &shard.size, &shard.contentHash, &shard.missing); err != nil {
+			return nil, fmt.Errorf("failed to scan shard row: %v", err)
+		}
+		shards[shard.fileID] = append(shards[shard.fileID], shard)
+	}
+
+	return shards, rows.Err()
+}
+
+// Find a file stripe of the config holding the content, nil if none
+func findFileStripeByHash(configName, contentHash string, size size_t) (*FileStripe, error) {
+	fs := &FileStripe{}
+	row := _db.QueryRow(
+		`SELECT id, filepath, k, m, config_name, size, stripe_depth, min_depth, wrapped_key, needs_repair, content_hash, chunked FROM file_stripes
+		WHERE config_name = ? AND content_hash = ? AND size = ? ORDER BY id LIMIT 1`, configName, contentHash, size)
+	err := row.Scan(&fs.ID, &fs.Filepath, &fs.K, &fs.M, &fs.ConfigName, &fs.Size, &fs.StripeDepth, &fs.MinDepth, &fs.WrappedKey, &fs.NeedsRepair, &fs.ContentHash, &fs.Chunked)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query file_stripes: %v", err)
+	}
+	return fs, loadChunks(fs)
+}
+
+// Count the shards of the config referring to the deduplicated content on
+// the server, which is kept while referred to
+func countShardRefs(configName, serverID, contentHash string) (int, error) {
+	var refs int
+	row := _db.QueryRow(
+		`SELECT COUNT(*) FROM shards s JOIN file_stripes f ON s.file_id = f.id
+		WHERE f.config_name = ? AND s.server_id = ? AND s.content_hash = ? AND NOT s.missing`, configName, serverID, contentHash)
+	if err := row.Scan(&refs); err != nil {
+		return 0, fmt.Errorf("failed to count shard references: %v", err)
+	}
+	return refs, nil
+}
+
+// Save a chunk of a chunked file stripe
+func saveChunk(db dbExecer, fileID int, chunk *chunk) error {
+	_, err := db.Exec(`INSERT INTO chunks (file_id, chunk_index, chunk_offset, size, shard_size, hash) VALUES (?, ?, ?, ?, ?, ?)`,
+		fileID, chunk.index, chunk.offset, chunk.size, chunk.shardSize, chunk.hash)
+	if err != nil {
+		return fmt.Errorf("failed to insert chunk: %v", err)
+	}
+	return nil
+}
+
+// Read the chunk index of a chunked file stripe
+func loadChunks(fs *FileStripe) error {
+	if !fs.Chunked {
+		return nil
+	}
+	rows, err := _db.Query(`SELECT chunk_index, chunk_offset, size, shard_size, hash FROM chunks WHERE file_id = ? ORDER BY chunk_index`, fs.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query chunks: %v", err)
+	}
+	defer rows.Close()
+
+	fs.chunks = nil
+	for rows.Next() {
+		chunk := chunk{}
+		if err := rows.Scan(&chunk.index, &chunk.offset, &chunk.size, &chunk.shardSize, &chunk.hash); err != nil {
+			return fmt.Errorf("failed to scan chunk row: %v", err)
+		}
+		fs.chunks = append(fs.chunks, chunk)
+	}
+	return rows.Err()
+}
+
+// Read the shards of a stored chunk of the content, striped with k + m and
+// sealed with the wrapped key, nil if none
+func getChunkShards(configName, hash string, k, m int, wrappedKey []byte) ([]Shard, error) {
+	var fileID, index int
+	row := _db.QueryRow(
+		`SELECT c.file_id, c.chunk_index FROM chunks c JOIN file_stripes f ON c.file_id = f.id
+		WHERE f.config_name = ? AND c.hash = ? AND f.k = ? AND f.m = ? AND f.wrapped_key IS ? LIMIT 1`, configName, hash, k, m, wrappedKey)
+	err := row.Scan(&fileID, &index)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to query chunks: %v", err)
+	}
+
+	n := k + m
+	rows, err := _db.Query(
+		`SELECT file_id, shard_index, server_id, shard_hashname, is_data_shard, size, COALESCE(content_hash, ''), missing FROM shards
+		WHERE file_id = ? AND shard_index >= ? AND shard_index < ? ORDER BY shard_index`, fileID, index*n, (index+1)*n)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query shards: %v", err)
+	}
+	defer rows.Close()
+
+	var shards []Shard
+	for rows.Next() {
+		shard := Shard{}
+		if err := rows.Scan(&shard.fileID, &shard.shardIndex, &shard.serverID, &shard.shardHashname, &shard.dataShard, &shard.size, &shard.contentHash, &shard.missing); err != nil {
+			return nil, fmt.Errorf("failed to scan shard row: %v", err)
+		}
+		shards = append(shards, shard)
+	}
+	return shards, rows.Err()
+}
+
 func SaveConfigToDB(config *Config) error {
 	// Insert config into the table
 	configData, err := json.Marshal(config)
@@ -0,0 +1,190 @@
+package rnas
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// casDirName is the directory of the content-addressed store of a config.
+// In dedup mode shards are named by their SHA-256 and shared by all the
+// objects of the config, a shard file is deleted once no shard refers to
+// it any more.
+const casDirName = "cas"
+
+// casDir returns the directory of the deduplicated shards
+func (c *Config) casDir() string {
+	return filepath.Join(c.Name, casDirName)
+}
+
+// casHash returns the content hash of a path of the content-addressed store
+func (c *Config) casHash(path string) (string, bool) {
+	dir, name := filepath.Split(path)
+	if filepath.Clean(dir) != c.casDir() {
+		return "", false
+	}
+	return strings.TrimSuffix(name, "."+fakeSuffix), true
+}
+
+// casPins counts the deduplicated shards that puts in progress store or
+// refer to, whose metadata is not committed yet and so keeps no file from
+// being deleted. Deleting a file of the store holds mu from the reference
+// check to the delete, so a put either pins the shard first or finds the
+// file gone.
+type casPins struct {
+	mu   sync.Mutex
+	pins map[string]int // by server and content hash
+	// called by pinShards before it waits for mu, set by tests
+	pinning func()
+}
+
+func casKey(serverID, contentHash string) string {
+	return serverID + "/" + contentHash
+}
+
+// pinShards keeps the deduplicated shard files from being deleted until
+// they are unpinned
+func (c *Config) pinShards(shards []Shard) {
+	if c.cas.pinning != nil {
+		c.cas.pinning()
+	}
+	c.cas.mu.Lock()
+	defer c.cas.mu.Unlock()
+	for i := range shards {
+		if shards[i].contentHash != "" {
+			c.cas.pins[casKey(shards[i].serverID, shards[i].contentHash)]++
+		}
+	}
+}
+
+func (c *Config) unpinShards(shards []Shard) {
+	c.cas.mu.Lock()
+	defer c.cas.mu.Unlock()
+	for i := range shards {
+		if shards[i].contentHash == "" {
+			continue
+		}
+		key := casKey(shards[i].serverID, shards[i].contentHash)
+		if c.cas.pins[key]--; c.cas.pins[key] <= 0 {
+			delete(c.cas.pins, key)
+		}
+	}
+}
+
+// pinStoredShards pins the shards of a stored object that are about to be
+// referred to. It returns false, pinning none, when some are not referred
+// to any more, as their files may be deleted already.
+func (c *Config) pinStoredShards(shards []Shard) (bool, error) {
+	c.pinShards(shards)
+	for i := range shards {
+		refs, err := countShardRefs(c.Name, shards[i].serverID, shards[i].contentHash)
+		if err != nil || refs == 0 {
+			c.unpinShards(shards)
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// hasSharedShard tells whether the deduplicated shard is already stored on
+// its server for another object, so that it needs no upload. The shard
+// must be pinned.
+func (c *Config) hasSharedShard(ctx context.Context, shard *Shard) bool {
+	if shard.contentHash == "" {
+		return false
+	}
+	refs, err := countShardRefs(c.Name, shard.serverID, shard.contentHash)
+	if err != nil || refs == 0 {
+		return false
+	}
+	// a lost file is uploaded again
+	server := c.maps[shard.serverID]
+	return server.driver.FindContext(ctx, c.shardPath(shard)) == nil
+}
+
+// isShared tells whether the shard file is referred to by other shards or
+// pinned by a put in progress, which keeps it from being deleted. The
+// caller holds c.cas.mu.
+func (c *Config) isShared(serverID, contentHash string) (bool, error) {
+	if c.cas.pins[casKey(serverID, contentHash)] > 0 {
+		return true, nil
+	}
+	refs, err := countShardRefs(c.Name, serverID, contentHash)
+	return refs > 0, err
+}
+
+// hashObject hashes the next size bytes of the object, then seeks back
+func hashObject(r io.ReadSeeker, size int64) (string, error) {
+	start, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	if _, err := io.CopyN(hash, r, size); err != nil {
+		return "", err
+	}
+	if _, err := r.Seek(start, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// putDuplicate stores the object as another name of a stored object of the
+// same content, whose shards are referred to instead of uploaded again.
+// It returns false when there is no such object.
+func (c *Config) putDuplicate(fs *FileStripe) (bool, error) {
+	src, err := findFileStripeByHash(c.Name, fs.ContentHash, fs.Size)
+	if err != nil || src == nil {
+		return false, err
+	}
+
+	shards, err := getShards(src.ID)
+	if err != nil {
+		return false, err
+	}
+	// only the shards of the content-addressed store can be shared
+	if len(shards) != len(src.layout())*(src.K+src.M) {
+		return false, nil
+	}
+	for i := range shards {
+		if shards[i].contentHash == "" || shards[i].missing {
+			return false, nil
+		}
+	}
+	ok, err := c.pinStoredShards(shards)
+	if !ok {
+		return false, err
+	}
+	defer c.unpinShards(shards)
+
+	tx, err := _db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	fs.WrappedKey = src.WrappedKey
+	fs.StripeConfig = src.StripeConfig
+	fs.Chunked = src.Chunked
+	fs.chunks = src.chunks
+	prevID, prevShards, err := c.saveVersion(tx, fs, shards)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	log.Infof("- same content as %s, %d shards are shared", src.Filepath, len(shards))
+	if prevID != 0 {
+		c.dropVersion(prevID, prevShards)
+	}
+	return true, nil
+}
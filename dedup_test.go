@@ -0,0 +1,144 @@
+package rnas
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// putWhileDeleting puts the data while the delete of the shard files of
+// the same content on s0 is blocked, then checks that the put keeps its
+// shards
+func putWhileDeleting(t *testing.T, c *Config, f *faults, data []byte) {
+	t.Helper()
+	// the delete holds the lock of the pins, released once the put waits
+	// to pin the shards of the deleted content
+	pinning := make(chan struct{}, 1)
+	c.cas.pinning = func() {
+		select {
+		case pinning <- struct{}{}:
+		default:
+		}
+	}
+	done := make(chan error, 1)
+	go func() { done <- c.Put("/b", int64(len(data)), bytes.NewReader(data)) }()
+	<-pinning
+	close(f.release)
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	report, err := c.Fsck(FsckOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Missing) != 0 {
+		t.Fatalf("%d shards of the put are deleted", len(report.Missing))
+	}
+	if !bytes.Equal(readAll(t, c, "/b"), data) {
+		t.Fatal("object reads back wrong")
+	}
+}
+
+func TestDedupDeleteKeepsShardsOfPut(t *testing.T) {
+	c := newTestConfig(t, 2, 1, 1, 3)
+	c.Dedup = true
+	data := randomData(t, 20000)
+	if err := c.Put("/a", int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	f := serverFaults(c.Servers[0])
+	f.blockDelete.Store(true)
+	deleted := make(chan error, 1)
+	go func() { deleted <- c.Delete("/a") }()
+	<-f.deleting
+
+	putWhileDeleting(t, c, f, data)
+	if err := <-deleted; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDedupRollbackKeepsShardsOfPut(t *testing.T) {
+	c := newTestConfig(t, 2, 1, 1, 3)
+	c.Dedup = true
+	data := randomData(t, 20000)
+
+	// the put fails on s2 and rolls back its shards on s0 and s1
+	failing := serverFaults(c.Servers[2])
+	failing.failCreate.Store(true)
+	f := serverFaults(c.Servers[0])
+	f.blockDelete.Store(true)
+	failed := make(chan error, 1)
+	go func() { failed <- c.Put("/a", int64(len(data)), bytes.NewReader(data)) }()
+
+	<-f.deleting
+	failing.failCreate.Store(false)
+
+	putWhileDeleting(t, c, f, data)
+	if err := <-failed; err == nil {
+		t.Fatal("put succeeded on a failing server")
+	}
+	if _, err := c.Stat("/a"); err == nil {
+		t.Error("/a is visible after the rollback")
+	}
+}
+
+func TestFsckKeepsShardsOfPut(t *testing.T) {
+	c := newTestConfig(t, 2, 1, 1, 3)
+	c.Dedup = true
+	f := serverFaults(c.Servers[2])
+	f.blockCreate.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	data := randomData(t, 20000)
+	done := make(chan error, 1)
+	go func() { done <- c.PutContext(ctx, "/a", int64(len(data)), bytes.NewReader(data)) }()
+
+	// the shards of the put on s0 and s1 are stored but not committed,
+	// and older than the grace of fsck
+	<-f.blocked
+	for serverFaults(c.Servers[0]).created.Load() == 0 || serverFaults(c.Servers[1]).created.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	old := time.Now().Add(-2 * fsckGrace)
+	var stored []string
+	for _, server := range c.Servers[:2] {
+		paths, err := filepath.Glob(filepath.Join(server.Path, c.casDir(), "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range paths {
+			if err := os.Chtimes(p, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+		stored = append(stored, paths...)
+	}
+
+	report, err := c.Fsck(FsckOptions{Fix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, orphan := range report.Orphans {
+		if orphan.Deleted {
+			t.Errorf("fsck deleted %s of the put in progress on server[%s]", orphan.Path, orphan.ServerID)
+		}
+	}
+	for _, p := range stored {
+		if _, err := os.Stat(p); err != nil {
+			t.Errorf("shard of the put in progress is gone: %v", err)
+		}
+	}
+
+	cancel()
+	if err := <-done; !errors.Is(err, context.Canceled) {
+		t.Fatalf("put returned %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,156 @@
+package rnas
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Delete removes the object along with its shards and per-file directories.
+// Shards that cannot be deleted now, e.g. on an unreachable server, are
+// recorded as pending deletions and retried later.
+func (c *Config) Delete(filepath string) error {
+	log.Infof("Delete object %s", filepath)
+
+	if err := c.RetryPendingDeletions(); err != nil {
+		log.Warnf("- failed to retry pending deletions: %v", err)
+	}
+
+	fs, err := c.getObject(filepath)
+	if err != nil {
+		return err
+	}
+
+	shards, err := getShards(fs.ID)
+	if err != nil {
+		return err
+	}
+
+	err = deleteFileStripe(fs.ID)
+	if err != nil {
+		return err
+	}
+
+	pending, err := c.deleteShardFiles(fs.ID, shards)
+	if err != nil {
+		return err
+	}
+
+	if pending > 0 {
+		log.Warnf("%s has been deleted, %d paths are pending deletion", filepath, pending)
+	} else {
+		log.Infof("%s has been deleted", filepath)
+	}
+	return nil
+}
+
+// deleteShardFiles deletes the shard files and the per-file directories
+// of a file whose metadata is already gone. Deduplicated shard files still
+// referred to by other objects are kept. Paths that fail to be deleted
+// are recorded as pending deletions, whose number is returned.
+func (c *Config) deleteShardFiles(fileID int, shards []Shard) (int, error) {
+	// no put pins a deduplicated shard between its check and its delete
+	c.cas.mu.Lock()
+	defer c.cas.mu.Unlock()
+
+	// paths to delete of every server, shard files before directories
+	paths := make(map[string][]string)
+	hasDir := make(map[string]bool)
+	seen := make(map[string]bool)
+	for i := range shards {
+		shard := &shards[i]
+		path := c.shardPath(shard)
+		if seen[shard.serverID+"/"+path] {
+			continue
+		}
+		seen[shard.serverID+"/"+path] = true
+		if shard.contentHash == "" {
+			paths[shard.serverID] = append(paths[shard.serverID], path)
+			hasDir[shard.serverID] = true
+			continue
+		}
+		shared, err := c.isShared(shard.serverID, shard.contentHash)
+		if err != nil {
+			return 0, err
+		}
+		if !shared {
+			paths[shard.serverID] = append(paths[shard.serverID], path)
+		}
+	}
+	for serverID := range hasDir {
+		paths[serverID] = append(paths[serverID], c.fileDir(fileID))
+	}
+
+	pending := 0
+	for serverID, paths := range paths {
+		for _, path := range paths {
+			err := c.deletePath(serverID, path)
+			if err == nil {
+				continue
+			}
+			log.Warnf("- failed to delete %s from server[%s], will retry later: %v", path, serverID, err)
+			if err := savePendingDeletion(_db, c.Name, serverID, path); err != nil {
+				return pending, err
+			}
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// RetryPendingDeletions retries to delete the paths that failed to be
+// deleted before
+func (c *Config) RetryPendingDeletions() error {
+	deletions, err := getPendingDeletions(c.Name)
+	if err != nil {
+		return err
+	}
+
+	if len(deletions) > 0 {
+		log.Infof("- retry %d pending deletions", len(deletions))
+	}
+
+	// no put pins a deduplicated shard between its check and its delete
+	c.cas.mu.Lock()
+	defer c.cas.mu.Unlock()
+
+	left := 0
+	for _, d := range deletions {
+		// a deduplicated shard may be referred to again since
+		if hash, ok := c.casHash(d.path); ok {
+			shared, err := c.isShared(d.serverID, hash)
+			if err != nil {
+				return err
+			}
+			if shared {
+				if err := removePendingDeletion(d.id); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		err := c.deletePath(d.serverID, d.path)
+		if err != nil {
+			log.Debugf("- still failed to delete %s from server[%s]: %v", d.path, d.serverID, err)
+			left++
+			continue
+		}
+		if err := removePendingDeletion(d.id); err != nil {
+			return err
+		}
+	}
+
+	if left > 0 {
+		log.Warnf("- %d pending deletions left", left)
+	}
+	return nil
+}
+
+func (c *Config) deletePath(serverID, path string) error {
+	server, ok := c.maps[serverID]
+	if !ok {
+		return fmt.Errorf("server[%s] doesn't exist", serverID)
+	}
+	return server.Delete(path)
+}
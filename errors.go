@@ -0,0 +1,57 @@
+package rnas
+
+import (
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrInvalidConfig is returned when the config breaks a constraint
+	ErrInvalidConfig = errors.New("invalid config")
+	// ErrNotEnoughServers is returned when there are too few (reachable)
+	// servers to hold the shards of a stripe
+	ErrNotEnoughServers = errors.New("not enough servers")
+	// ErrDuplicateServerID is returned when two servers share an id
+	ErrDuplicateServerID = errors.New("duplicate server id")
+	// ErrUnsupportedDriver is returned when the type of a server is unknown
+	ErrUnsupportedDriver = errors.New("unsupported driver")
+	// ErrShardCorrupted is returned when a shard fails verification
+	ErrShardCorrupted = errors.New("shard corrupted")
+	// ErrWriteQuorum is returned when too few shards of a stripe could be
+	// stored during a put
+	ErrWriteQuorum = errors.New("write quorum not reached")
+)
+
+// ShardError describes a shard that a server failed to serve correctly
+type ShardError struct {
+	Filepath   string
+	ShardIndex int
+	ServerID   string
+	Err        error
+}
+
+func (e *ShardError) Error() string {
+	return fmt.Sprintf("shard %d of %s from server[%s]: %v", e.ShardIndex, e.Filepath, e.ServerID, e.Err)
+}
+
+func (e *ShardError) Unwrap() error {
+	return e.Err
+}
+
+// corruptShard reports a corrupt shard to the OnShardError hook, the shard
+// is then treated as a missing one and recovered from the others
+func (c *Config) corruptShard(fs *FileStripe, shard *Shard, err error) *ShardError {
+	shardErr := &ShardError{
+		Filepath:   fs.Filepath,
+		ShardIndex: shard.shardIndex,
+		ServerID:   shard.serverID,
+		Err:        fmt.Errorf("%w: %v", ErrShardCorrupted, err),
+	}
+	log.Warn(shardErr)
+	if c.OnShardError != nil {
+		c.OnShardError(shardErr)
+	}
+	return shardErr
+}
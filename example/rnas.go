@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
+	"text/tabwriter"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	log "github.com/sirupsen/logrus"
 	"github.com/yztz/rnas"
+	"github.com/yztz/rnas/storage"
 )
 
 var _Dryrun = false
@@ -27,6 +35,14 @@ func main() {
 	testCmd := flag.NewFlagSet("test", flag.ExitOnError)
 	putCmd := flag.NewFlagSet("put", flag.ExitOnError)
 	getCmd := flag.NewFlagSet("get", flag.ExitOnError)
+	rebuildCmd := flag.NewFlagSet("rebuild", flag.ExitOnError)
+	rmCmd := flag.NewFlagSet("rm", flag.ExitOnError)
+	lsCmd := flag.NewFlagSet("ls", flag.ExitOnError)
+	statCmd := flag.NewFlagSet("stat", flag.ExitOnError)
+	scrubCmd := flag.NewFlagSet("scrub", flag.ExitOnError)
+	serveShardsCmd := flag.NewFlagSet("serve-shards", flag.ExitOnError)
+	sweepCmd := flag.NewFlagSet("sweep", flag.ExitOnError)
+	fsckCmd := flag.NewFlagSet("fsck", flag.ExitOnError)
 	// putCmd := flag.NewFlagSet("put", flag.ExitOnError)
 	// getCmd := flag.NewFlagSet("get", flag.ExitOnError)
 
@@ -36,6 +52,26 @@ func main() {
 	putConfig := putCmd.String("config", "default", "Name of configuration")
 	Dryrun = putCmd.Bool("dryrun", false, "Dryrun")
 	getConfig := getCmd.String("config", "default", "Name of configuration")
+	getOffset := getCmd.Int64("offset", 0, "Offset of the range to get")
+	getLength := getCmd.Int64("length", -1, "Length of the range to get, -1 means to the end")
+	rebuildConfig := rebuildCmd.String("config", "default", "Name of configuration")
+	rebuildServer := rebuildCmd.String("server", "", "Id of the lost server")
+	rmConfig := rmCmd.String("config", "default", "Name of configuration")
+	lsConfig := lsCmd.String("config", "default", "Name of configuration")
+	statConfig := statCmd.String("config", "default", "Name of configuration")
+	scrubConfig := scrubCmd.String("config", "default", "Name of configuration")
+	scrubQuick := scrubCmd.Bool("quick", false, "Only check that shards exist, without reading them")
+	scrubRepair := scrubCmd.Bool("repair", false, "Reconstruct and rewrite bad shards")
+	sweepConfig := sweepCmd.String("config", "default", "Name of configuration")
+	sweepAge := sweepCmd.Duration("age", time.Hour, "Min age of the temporary files to delete")
+	fsckConfig := fsckCmd.String("config", "default", "Name of configuration")
+	fsckFix := fsckCmd.Bool("fix", false, "Delete orphan files and flag incomplete objects for repair")
+	serveRoot := serveShardsCmd.String("root", "", "Directory of shards to serve")
+	serveListen := serveShardsCmd.String("listen", ":8090", "Address to listen on")
+	serveToken := serveShardsCmd.String("token", os.Getenv("RNAS_SHARD_TOKEN"), "Token required from clients, $RNAS_SHARD_TOKEN by default")
+	serveCert := serveShardsCmd.String("cert", "", "TLS certificate file")
+	serveKey := serveShardsCmd.String("key", "", "TLS key file")
+	serveInsecure := serveShardsCmd.Bool("insecure", false, "Serve without a token, letting anyone read and write shards")
 	
 	// configName := createCmd.String("name", "default", "Name of configuration")
 
@@ -45,7 +81,14 @@ func main() {
 
 	if len(os.Args) < 2 {
 		fmt.Println("Usage: go run main.go <command> [options]")
-		fmt.Println("Commands: create, put, get")
+		fmt.Println("Commands: create, test, put, get, rm, ls, stat, scrub, fsck, rebuild, sweep, serve-shards")
+		return
+	}
+
+	// a shard server needs no database
+	if os.Args[1] == "serve-shards" {
+		serveShardsCmd.Parse(os.Args[2:])
+		handleServeShards(*serveRoot, *serveListen, *serveToken, *serveCert, *serveKey, *serveInsecure)
 		return
 	}
 
@@ -56,7 +99,10 @@ func main() {
 	}
 	defer db.Close()
 
-	rnas.InitDB(db)
+	err = rnas.InitDB(db)
+	if err != nil {
+		log.Fatalf("Failed to init SQLite database: %v\n", err)
+	}
 
 	switch os.Args[1] {
 	case "create":
@@ -74,7 +120,36 @@ func main() {
 		getCmd.Parse(os.Args[2:])
 		filepath := getCmd.Arg(0)
 		targetPath := getCmd.Arg(1)
-		handleGet(*getConfig, filepath, targetPath)
+		if *getOffset != 0 || *getLength >= 0 {
+			handleGetRange(*getConfig, filepath, targetPath, *getOffset, *getLength)
+		} else {
+			handleGet(*getConfig, filepath, targetPath)
+		}
+	case "rm":
+		rmCmd.Parse(os.Args[2:])
+		filepath := rmCmd.Arg(0)
+		handleRm(*rmConfig, filepath)
+	case "ls":
+		lsCmd.Parse(os.Args[2:])
+		prefix := lsCmd.Arg(0)
+		handleLs(*lsConfig, prefix)
+	case "stat":
+		statCmd.Parse(os.Args[2:])
+		filepath := statCmd.Arg(0)
+		handleStat(*statConfig, filepath)
+	case "scrub":
+		scrubCmd.Parse(os.Args[2:])
+		filepath := scrubCmd.Arg(0)
+		handleScrub(*scrubConfig, rnas.ScrubOptions{Filepath: filepath, Quick: *scrubQuick, Repair: *scrubRepair})
+	case "fsck":
+		fsckCmd.Parse(os.Args[2:])
+		handleFsck(*fsckConfig, rnas.FsckOptions{Fix: *fsckFix})
+	case "rebuild":
+		rebuildCmd.Parse(os.Args[2:])
+		handleRebuild(*rebuildConfig, *rebuildServer)
+	case "sweep":
+		sweepCmd.Parse(os.Args[2:])
+		handleSweep(*sweepConfig, *sweepAge)
 	// case "put":
 	// 	putCmd.Parse(os.Args[2:])
 	// 	handlePut(*putKey)
@@ -84,7 +159,7 @@ func main() {
 	default:
 		fmt.Println("Unknown command:", os.Args[1])
 		fmt.Println("Usage: go run main.go <command> [options]")
-		fmt.Println("Commands: create, put, get")
+		fmt.Println("Commands: create, test, put, get, rm, ls, stat, scrub, fsck, rebuild, sweep, serve-shards")
 	}
 }
 
@@ -100,7 +175,10 @@ func handleCreate(configPath string) {
 		log.Fatalf("Failed to parse config file: %v\n", err)
 	}
 
-	config.Init()
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	// Save configuration to database
 	err = rnas.SaveConfigToDB(&config)
@@ -117,9 +195,15 @@ func handleTest(configName string) {
 	if err != nil {
 		log.Fatal(err)
 	}
-	config.Init()
-	config.TestAll()
-	
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.TestAll()
+	if err != nil {
+		log.Fatal(err)
+	}
+
 }
 
 func getFileSize(filepath string) (int64, error) {
@@ -139,6 +223,24 @@ func handlePut(configName, filepath, targetPath string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// roll back the put on ctrl-c
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// read from stdin
+	if filepath == "-" {
+		err = config.Init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = config.PutStreamContext(ctx, targetPath, os.Stdin)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	size, err := getFileSize(filepath)
 	if err != nil {
 		log.Fatal(err)
@@ -149,8 +251,11 @@ func handlePut(configName, filepath, targetPath string) {
 	}
 	defer f.Close()
 
-	config.Init()
-	err = config.Put(targetPath, size, f)
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.PutContext(ctx, targetPath, size, f)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -167,11 +272,17 @@ func handleGet(configName, filepath, targetPath string) {
 		log.Fatal(err)
 	}
 	defer f.Close()
-	config.Init()
-	reader, err := config.ReadStream(filepath)
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	reader, err := config.ReadStreamContext(ctx, filepath)
 	if err != nil {
 		log.Fatal(err)
 	}
+	defer reader.Close()
 	now := time.Now()
 	w, err := io.Copy(f, reader)
 	end := time.Since(now)
@@ -181,4 +292,292 @@ func handleGet(configName, filepath, targetPath string) {
 		log.Fatal(err)
 	}
 	fmt.Printf("done, %d bytes written.\n", w)
-}
\ No newline at end of file
+}
+
+func handleGetRange(configName, filepath, targetPath string, offset, length int64) {
+	config,err := rnas.LoadConfigFromDB(configName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.OpenFile(targetPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	object, err := config.Open(filepath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer object.Close()
+
+	if length < 0 {
+		length = object.Size() - offset
+	}
+	now := time.Now()
+	w, err := io.Copy(f, io.NewSectionReader(object, offset, length))
+	end := time.Since(now)
+	fmt.Printf("%s [%d, %d) has been retrived, took %v, speed %.2fB/s\n", filepath, offset, offset + w, end, float64(w) / float64(end.Seconds()))
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("done, %d bytes written.\n", w)
+}
+
+func handleRm(configName, filepath string) {
+	config,err := rnas.LoadConfigFromDB(configName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Delete(filepath)
+	if errors.Is(err, fs.ErrNotExist) {
+		log.Fatalf("%s not found", filepath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func handleLs(configName, prefix string) {
+	config,err := rnas.LoadConfigFromDB(configName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	stats, err := config.List(prefix)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tK+M\tDEPTH\tSTRIPES\tHEALTH")
+	for _, stat := range stats {
+		health := fmt.Sprintf("%s (%d/%d)", stat.Health, stat.MinAvailable, stat.K + stat.M)
+		if stat.NeedsRepair {
+			health += ", needs repair"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d+%d\t%d\t%d\t%s\n", stat.Filepath, stat.Size, stat.K, stat.M,
+			stat.StripeDepth, stat.Stripes, health)
+	}
+	w.Flush()
+}
+
+func handleStat(configName, filepath string) {
+	config,err := rnas.LoadConfigFromDB(configName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	stat, err := config.Stat(filepath)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", stat.Filepath)
+	fmt.Fprintf(w, "Config:\t%s\n", stat.ConfigName)
+	fmt.Fprintf(w, "Size:\t%d\n", stat.Size)
+	fmt.Fprintf(w, "K+M:\t%d+%d\n", stat.K, stat.M)
+	fmt.Fprintf(w, "Stripe depth:\t%d\n", stat.StripeDepth)
+	fmt.Fprintf(w, "Min depth:\t%d\n", stat.MinDepth)
+	fmt.Fprintf(w, "Stripes:\t%d\n", stat.Stripes)
+	if stat.Chunked {
+		fmt.Fprintf(w, "Chunked:\t%v, a stripe per chunk\n", stat.Chunked)
+	}
+	fmt.Fprintf(w, "Encrypted:\t%v\n", stat.WrappedKey != nil)
+	fmt.Fprintf(w, "Health:\t%s, at least %d/%d shards of every stripe available\n", stat.Health, stat.MinAvailable, stat.K + stat.M)
+	fmt.Fprintf(w, "Needs repair:\t%v\n", stat.NeedsRepair)
+	if stat.ContentHash != "" {
+		fmt.Fprintf(w, "SHA-256:\t%s\n", stat.ContentHash)
+	}
+	fmt.Fprintln(w, "Shards:")
+
+	servers := make([]string, 0, len(stat.Distribution))
+	for server := range stat.Distribution {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+	for _, server := range servers {
+		fmt.Fprintf(w, "  %s\t%d\n", server, stat.Distribution[server])
+	}
+	w.Flush()
+}
+
+func handleScrub(configName string, opts rnas.ScrubOptions) {
+	config,err := rnas.LoadConfigFromDB(configName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := config.Scrub(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Objects:\t%d\n", report.Objects)
+	fmt.Fprintf(w, "Shards:\t%d\n", report.Shards)
+	fmt.Fprintf(w, "Bad shards:\t%d\n", len(report.BadShards))
+	fmt.Fprintf(w, "Unrepaired:\t%d\n", report.Unrepaired())
+
+	if len(report.BadShards) > 0 {
+		fmt.Fprintln(w, "\nOBJECT\tSHARD\tSERVER\tPROBLEM\tREPAIRED")
+		for _, bad := range report.BadShards {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%v\n", bad.Filepath, bad.ShardIndex, bad.ServerID, bad.Problem, bad.Repaired)
+		}
+
+		fmt.Fprintln(w, "\nSERVER\tBAD SHARDS")
+		perServer := report.PerServer()
+		servers := make([]string, 0, len(perServer))
+		for server := range perServer {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+		for _, server := range servers {
+			fmt.Fprintf(w, "%s\t%d\n", server, perServer[server])
+		}
+	}
+
+	if len(report.Failed) > 0 {
+		fmt.Fprintln(w, "\nOBJECT\tERROR")
+		for filepath, err := range report.Failed {
+			fmt.Fprintf(w, "%s\t%v\n", filepath, err)
+		}
+	}
+	w.Flush()
+
+	if report.Unrepaired() > 0 || len(report.Failed) > 0 {
+		os.Exit(1)
+	}
+}
+
+func handleFsck(configName string, opts rnas.FsckOptions) {
+	config,err := rnas.LoadConfigFromDB(configName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	report, err := config.Fsck(opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Objects:\t%d\n", report.Objects)
+	fmt.Fprintf(w, "Shards:\t%d\n", report.Shards)
+	fmt.Fprintf(w, "Files listed:\t%d\n", report.Files)
+	fmt.Fprintf(w, "Orphans:\t%d\n", len(report.Orphans))
+	fmt.Fprintf(w, "Missing shards:\t%d\n", len(report.Missing))
+	fmt.Fprintf(w, "Incomplete objects:\t%d\n", len(report.Incomplete))
+
+	if len(report.Orphans) > 0 {
+		fmt.Fprintln(w, "\nORPHAN\tSERVER\tDELETED")
+		for _, orphan := range report.Orphans {
+			fmt.Fprintf(w, "%s\t%s\t%v\n", orphan.Path, orphan.ServerID, orphan.Deleted)
+		}
+	}
+
+	if len(report.Missing) > 0 {
+		fmt.Fprintln(w, "\nOBJECT\tSHARD\tSERVER\tPROBLEM")
+		for _, missing := range report.Missing {
+			fmt.Fprintf(w, "%s\t%d\t%s\t%s\n", missing.Filepath, missing.ShardIndex, missing.ServerID, missing.Problem)
+		}
+	}
+
+	if len(report.Incomplete) > 0 {
+		fmt.Fprintln(w, "\nINCOMPLETE\tREASON\tMARKED")
+		for _, object := range report.Incomplete {
+			fmt.Fprintf(w, "%s\t%s\t%v\n", object.Filepath, object.Reason, object.Marked)
+		}
+	}
+
+	if len(report.Unchecked) > 0 {
+		fmt.Fprintln(w, "\nUNCHECKED SERVER\tERROR")
+		for server, err := range report.Unchecked {
+			fmt.Fprintf(w, "%s\t%v\n", server, err)
+		}
+	}
+	w.Flush()
+
+	if !report.Clean() || len(report.Unchecked) > 0 {
+		os.Exit(1)
+	}
+}
+
+func handleRebuild(configName, serverID string) {
+	if serverID == "" {
+		log.Fatal("--server is required")
+	}
+	config,err := rnas.LoadConfigFromDB(configName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Rebuild(serverID)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func handleSweep(configName string, age time.Duration) {
+	config,err := rnas.LoadConfigFromDB(configName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = config.Init()
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = config.SweepTemp(age)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func handleServeShards(root, listen, token, cert, key string, insecure bool) {
+	if root == "" {
+		log.Fatal("--root is required")
+	}
+	if token == "" {
+		if !insecure {
+			log.Fatal("--token or $RNAS_SHARD_TOKEN is required, or --insecure to serve without a token")
+		}
+		log.Warn("no token is set, anyone reaching the server can read and write shards")
+	}
+	server, err := storage.NewShardServer(root, token)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Infof("serving shards of %s on %s", root, listen)
+	if cert != "" {
+		err = http.ListenAndServeTLS(listen, cert, key, server)
+	} else {
+		err = http.ListenAndServe(listen, server)
+	}
+	log.Fatal(err)
+}
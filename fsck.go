@@ -0,0 +1,287 @@
+package rnas
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yztz/rnas/storage"
+)
+
+// orphans modified more recently may belong to a put in progress, whose
+// metadata is not committed yet, and are never deleted
+const fsckGrace = time.Hour
+
+type FsckOptions struct {
+	// delete the orphans and flag the incomplete objects for repair
+	Fix bool
+}
+
+// OrphanShard is a file of a server that no shard refers to
+type OrphanShard struct {
+	ServerID string
+	Path     string
+	Deleted  bool
+}
+
+// MissingShard is a shard whose file is absent from its server, or has a
+// wrong size
+type MissingShard struct {
+	Filepath   string
+	ShardIndex int
+	ServerID   string
+	Problem    ShardProblem
+}
+
+// IncompleteObject is an object lacking shards
+type IncompleteObject struct {
+	Filepath string
+	Reason   string
+	// flagged for repair
+	Marked bool
+}
+
+type FsckReport struct {
+	Objects    int
+	Shards     int
+	Files      int // files listed on the servers
+	Orphans    []OrphanShard
+	Missing    []MissingShard
+	Incomplete []IncompleteObject
+	// servers whose files could not be listed
+	Unchecked map[string]error
+}
+
+// Clean tells whether nothing is left to fix
+func (r *FsckReport) Clean() bool {
+	for _, orphan := range r.Orphans {
+		if !orphan.Deleted {
+			return false
+		}
+	}
+	return len(r.Missing) == 0 && len(r.Incomplete) == 0
+}
+
+// Fsck cross-references the files stored on the servers with the shards
+// recorded in the database, reporting the orphan files, the missing shards
+// and the incomplete objects
+func (c *Config) Fsck(opts FsckOptions) (*FsckReport, error) {
+	log.Infof("Fsck config %s", c.Name)
+
+	files, err := getFileStripes(c.Name, "")
+	if err != nil {
+		return nil, err
+	}
+	shardsByFile, err := getShardsByPrefix(c.Name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// the shards expected on every server by path, which several shards of
+	// the same content may share
+	type shardRef struct {
+		fs    *FileStripe
+		shard *Shard
+	}
+	expected := make(map[string]map[string][]shardRef)
+	for _, server := range c.Servers {
+		expected[server.Id] = make(map[string][]shardRef)
+	}
+	known := make(map[int]bool)
+	for _, fs := range files {
+		known[fs.ID] = true
+		shards := shardsByFile[fs.ID]
+		for i := range shards {
+			shard := &shards[i]
+			if expected[shard.serverID] == nil {
+				// a removed server, the shard is reported by scrub
+				continue
+			}
+			p := filepath.ToSlash(c.shardPath(shard))
+			expected[shard.serverID][p] = append(expected[shard.serverID][p], shardRef{fs, shard})
+		}
+	}
+
+	report := &FsckReport{Objects: len(files), Unchecked: make(map[string]error)}
+	missing := make(map[int][]MissingShard)
+	for _, server := range c.Servers {
+		if !server.reachable {
+			report.Unchecked[server.Id] = fmt.Errorf("server[%s] is unreachable", server.Id)
+			continue
+		}
+		listed, err := server.listShardFiles(c.Name)
+		if err != nil {
+			log.Warnf("- failed to list files of server[%s]: %v", server.Id, err)
+			report.Unchecked[server.Id] = err
+			continue
+		}
+		report.Files += len(listed)
+
+		for p, info := range listed {
+			if _, ok := expected[server.Id][p]; ok {
+				continue
+			}
+			orphan := OrphanShard{ServerID: server.Id, Path: p}
+			if opts.Fix && time.Since(info.ModTime) > fsckGrace {
+				deleted, err := c.deleteOrphan(server, p)
+				if err != nil {
+					log.Warnf("- failed to delete orphan %s from server[%s]: %v", p, server.Id, err)
+				}
+				orphan.Deleted = deleted
+			}
+			log.Warnf("- orphan %s on server[%s], deleted: %v", p, server.Id, orphan.Deleted)
+			report.Orphans = append(report.Orphans, orphan)
+		}
+
+		for p, refs := range expected[server.Id] {
+			info, ok := listed[p]
+			problem := ShardMissing
+			if ok {
+				if info.Size == int64(refs[0].shard.size) {
+					continue
+				}
+				problem = ShardCorrupt
+			}
+			for _, ref := range refs {
+				log.Warnf("- shard %d of %s on server[%s] is %s", ref.shard.shardIndex, ref.fs.Filepath, server.Id, problem)
+				missing[ref.fs.ID] = append(missing[ref.fs.ID], MissingShard{
+					Filepath:   ref.fs.Filepath,
+					ShardIndex: ref.shard.shardIndex,
+					ServerID:   server.Id,
+					Problem:    problem,
+				})
+			}
+		}
+
+		if opts.Fix {
+			server.deleteOrphanDirs(c.Name, known)
+		}
+	}
+
+	for _, fs := range files {
+		shards := shardsByFile[fs.ID]
+		report.Shards += len(shards)
+		report.Missing = append(report.Missing, missing[fs.ID]...)
+
+		reason := c.incompleteReason(fs, shards, missing[fs.ID])
+		if reason == "" {
+			continue
+		}
+		object := IncompleteObject{Filepath: fs.Filepath, Reason: reason}
+		if opts.Fix {
+			if err := setNeedsRepair(fs.ID, true); err != nil {
+				return nil, err
+			}
+			object.Marked = true
+		}
+		log.Warnf("- %s is incomplete: %s", fs.Filepath, reason)
+		report.Incomplete = append(report.Incomplete, object)
+	}
+
+	log.Infof("Fsck done, %d objects, %d shards, %d files listed, %d orphans, %d missing shards, %d incomplete objects",
+		report.Objects, report.Shards, report.Files, len(report.Orphans), len(report.Missing), len(report.Incomplete))
+	return report, nil
+}
+
+// incompleteReason tells why the object is incomplete, or returns an empty
+// string when it is complete
+func (c *Config) incompleteReason(fs *FileStripe, shards []Shard, missing []MissingShard) string {
+	n := fs.K + fs.M
+	stripes := len(fs.layout())
+	if len(shards) != stripes*n {
+		return fmt.Sprintf("%d/%d shards recorded", len(shards), stripes*n)
+	}
+	if len(missing) == 0 {
+		return ""
+	}
+
+	perStripe := make(map[int]int)
+	worst := 0
+	for _, m := range missing {
+		perStripe[m.ShardIndex/n]++
+		worst = max(worst, perStripe[m.ShardIndex/n])
+	}
+	if worst > fs.M {
+		return fmt.Sprintf("%d shards missing, some stripes are lost", len(missing))
+	}
+	return fmt.Sprintf("%d shards missing", len(missing))
+}
+
+// listShardFiles lists the files under the per-file directories of the
+// config, by path. Temporary files are left to the sweep.
+func (server *Server) listShardFiles(configName string) (map[string]storage.FileInfo, error) {
+	dirs, err := storage.List(server.driver, configName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]storage.FileInfo)
+	for _, dir := range dirs {
+		if !dir.IsDir {
+			continue
+		}
+		dirPath := path.Join(configName, dir.Name)
+		infos, err := storage.List(server.driver, dirPath)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.IsDir || storage.IsTemp(info.Name) {
+				continue
+			}
+			files[path.Join(dirPath, info.Name)] = info
+		}
+	}
+	return files, nil
+}
+
+// deleteOrphanDirs deletes the per-file directories of unknown files once
+// they are empty and past the grace period. The Delete of some drivers is
+// recursive, so a directory a put is writing to must never reach it.
+func (server *Server) deleteOrphanDirs(configName string, known map[int]bool) {
+	dirs, err := storage.List(server.driver, configName)
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(dir.Name)
+		if !dir.IsDir || err != nil || known[id] || time.Since(dir.ModTime) <= fsckGrace {
+			continue
+		}
+		dirPath := path.Join(configName, dir.Name)
+		infos, err := storage.List(server.driver, dirPath)
+		if err != nil || len(infos) > 0 {
+			log.Debugf("- keep directory %s on server[%s], %d entries: %v", dirPath, server.Id, len(infos), err)
+			continue
+		}
+		if err := server.Delete(dirPath); err != nil {
+			log.Debugf("- failed to delete directory %s on server[%s]: %v", dirPath, server.Id, err)
+		}
+	}
+}
+
+// deleteOrphan deletes an unreferenced file, keeping a deduplicated shard
+// that a put in progress pins or an object committed since the listing
+// refers to
+func (c *Config) deleteOrphan(server *Server, p string) (bool, error) {
+	if hash, ok := c.casHash(filepath.FromSlash(p)); ok {
+		c.cas.mu.Lock()
+		defer c.cas.mu.Unlock()
+		shared, err := c.isShared(server.Id, hash)
+		if err != nil || shared {
+			return false, err
+		}
+	}
+	if err := server.Delete(p); err != nil {
+		return false, err
+	}
+	return true, nil
+}
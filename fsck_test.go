@@ -0,0 +1,49 @@
+package rnas
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFsckKeepsDirsInUse(t *testing.T) {
+	c := newTestConfig(t, 2, 1, 1, 3)
+	root := c.Servers[0].Path
+	old := time.Now().Add(-2 * fsckGrace)
+
+	// a put in progress writing to the directory of a new object
+	busy := filepath.Join(root, c.Name, "100")
+	if err := os.MkdirAll(busy, 0755); err != nil {
+		t.Fatal(err)
+	}
+	shard := filepath.Join(busy, "0.jpg")
+	if err := os.WriteFile(shard, []byte("shard"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(busy, old, old); err != nil {
+		t.Fatal(err)
+	}
+	// the directory of an object deleted long ago
+	empty := filepath.Join(root, c.Name, "101")
+	if err := os.MkdirAll(empty, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(empty, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := c.Fsck(FsckOptions{Fix: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Orphans) != 1 || report.Orphans[0].Deleted {
+		t.Fatalf("fsck reported orphans %+v, want one kept", report.Orphans)
+	}
+	if _, err := os.Stat(shard); err != nil {
+		t.Errorf("shard of the put in progress is gone: %v", err)
+	}
+	if _, err := os.Stat(empty); !os.IsNotExist(err) {
+		t.Errorf("empty orphan directory is left: %v", err)
+	}
+}
@@ -3,13 +3,19 @@ module github.com/yztz/rnas
 go 1.22.2
 
 require (
+	github.com/jlaffaye/ftp v0.2.0
+	github.com/klauspost/reedsolomon v1.12.4
+	github.com/pkg/sftp v1.13.6
 	github.com/sirupsen/logrus v1.9.3
 	github.com/studio-b12/gowebdav v0.9.0
+	golang.org/x/crypto v0.27.0
 )
 
 require (
+	github.com/hashicorp/errwrap v1.0.0 // indirect
+	github.com/hashicorp/go-multierror v1.1.1 // indirect
 	github.com/klauspost/cpuid/v2 v2.2.8 // indirect
-	github.com/klauspost/reedsolomon v1.12.4 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 )
 
 require (
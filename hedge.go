@@ -0,0 +1,152 @@
+package rnas
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// a read is hedged once it takes hedgeFactor times longer than expected
+	hedgeFactor = 2
+	// min delay before hedging a read, covering the request latency
+	hedgeMinDelay = 100 * time.Millisecond
+	// delay before hedging a read from servers of unknown throughput
+	hedgeDefaultDelay = time.Second
+)
+
+type shardResult struct {
+	index int // index of the shard in the stripe
+	data  []byte
+	err   error
+}
+
+// hedgeOrder returns the indexes of the shards of a stripe in the order to
+// read them: the fastest servers first, unavailable servers last
+func (c *Config) hedgeOrder(shards []Shard) []int {
+	speed := make([]float64, len(shards))
+	for j := range shards {
+		server, ok := c.maps[shards[j].serverID]
+		if !ok || !server.reachable || shards[j].missing {
+			speed[j] = -1
+			continue
+		}
+		speed[j] = server.downloadThroughput()
+	}
+
+	order := make([]int, len(shards))
+	for j := range order {
+		order[j] = j
+	}
+	// stable, so data shards go first among servers of the same speed
+	sort.SliceStable(order, func(a, b int) bool {
+		return speed[order[a]] > speed[order[b]]
+	})
+	return order
+}
+
+// hedgeDelay is the time to wait for a read of the shard before issuing
+// another one
+func (c *Config) hedgeDelay(fs *FileStripe, shard *Shard, shardSize int) time.Duration {
+	server, ok := c.maps[shard.serverID]
+	if !ok {
+		return hedgeMinDelay
+	}
+	speed := server.downloadThroughput()
+	if speed <= 0 {
+		return hedgeDefaultDelay
+	}
+	expected := time.Duration(float64(fs.storedShardSize(shardSize)) / speed * float64(time.Second))
+	return hedgeMinDelay + hedgeFactor*expected
+}
+
+// readStripeHedged reads the data shards of a stripe. Only K shards are read
+// at first, from the fastest servers. Whenever a read fails or is slower
+// than its latency budget, one more shard is read, and the stripe is
+// reconstructed from the first K valid shards. The reads left are
+// cancelled.
+func (c *Config) readStripeHedged(ctx context.Context, enc reedsolomon.Encoder, fs *FileStripe, shards []Shard, shardSize int) ([][]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	order := c.hedgeOrder(shards)
+	results := make(chan shardResult, len(shards))
+	stripe := make([][]byte, len(shards))
+
+	next := 0
+	inflight := 0
+	// issue reads one more shard, returning the latency budget of the read
+	issue := func() time.Duration {
+		j := order[next]
+		next++
+		inflight++
+		shard := &shards[j]
+		go func() {
+			data, err := c.loadShard(ctx, fs, shard, shardSize)
+			if err != nil && !errors.Is(err, ErrShardCorrupted) && ctx.Err() == nil {
+				// a corrupt shard is counted as a missing one, and reported already
+				log.Warnf("retrieve shard %d error: %v", shard.shardIndex, err)
+			}
+			results <- shardResult{j, data, err}
+		}()
+		return c.hedgeDelay(fs, shard, shardSize)
+	}
+
+	var budget time.Duration
+	for next < fs.K {
+		budget = max(budget, issue())
+	}
+	timer := time.NewTimer(budget)
+	defer timer.Stop()
+
+	valid := 0
+	var errs []error
+	for valid < fs.K {
+		if inflight == 0 {
+			return nil, errors.Join(errs...)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-timer.C:
+			if next < len(order) {
+				log.Debugf("- shard read is slow, hedge with shard %d", shards[order[next]].shardIndex)
+				timer.Reset(issue())
+			}
+		case r := <-results:
+			inflight--
+			if r.err != nil {
+				errs = append(errs, r.err)
+				if next < len(order) {
+					issue()
+				}
+				continue
+			}
+			stripe[r.index] = r.data
+			valid++
+		}
+	}
+	cancel()
+
+	for j := 0; j < fs.K; j++ {
+		if stripe[j] == nil {
+			log.Debug("- got enough shards, restore data")
+			if err := enc.ReconstructData(stripe); err != nil {
+				return nil, fmt.Errorf("failed to restore data: %v", err)
+			}
+			break
+		}
+	}
+	for j := fs.K; j < len(stripe); j++ {
+		if stripe[j] != nil {
+			c.shardBuffers.put(stripe[j])
+		}
+	}
+	return stripe[:fs.K], nil
+}
@@ -0,0 +1,256 @@
+package rnas
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sirupsen/logrus"
+)
+
+// Object is a random accessible view of a stored object.
+// Only the stripes and shard ranges covering the requested bytes are fetched.
+type Object struct {
+	config  *Config
+	fs      *FileStripe
+	shards  []Shard
+	stripes []stripeLayout
+	enc     reedsolomon.Encoder
+
+	mu     sync.Mutex
+	offset int64
+	closed bool
+}
+
+var _ io.ReadSeekCloser = (*Object)(nil)
+var _ io.ReaderAt = (*Object)(nil)
+
+// getObject reads the object stored at the path by the config, an object
+// of another config doesn't exist for it
+func (c *Config) getObject(filepath string) (*FileStripe, error) {
+	file, err := getFileStripe(filepath)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("object %s: %w", filepath, fs.ErrNotExist)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if file.ConfigName != c.Name {
+		return nil, fmt.Errorf("object %s of config %s: %w", filepath, c.Name, fs.ErrNotExist)
+	}
+	return file, nil
+}
+
+// Open opens the object for random access reading
+func (c *Config) Open(filepath string) (*Object, error) {
+	log.Infof("Open object %s", filepath)
+
+	fs, err := c.getObject(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.loadObjectCipher(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := getShards(fs.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	stripes := fs.layout()
+	if len(shards) != len(stripes)*(fs.K+fs.M) {
+		return nil, fmt.Errorf("bad shards number: %d", len(shards))
+	}
+
+	enc, err := reedsolomon.New(fs.K, fs.M)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Object{config: c, fs: fs, shards: shards, stripes: stripes, enc: enc}, nil
+}
+
+// Size returns the size of the object
+func (o *Object) Size() int64 {
+	return int64(o.fs.Size)
+}
+
+// ReadAt reads len(p) bytes of the object starting at off
+func (o *Object) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= o.Size() {
+		return 0, io.EOF
+	}
+
+	end := min(off+int64(len(p)), o.Size())
+
+	// first stripe containing off
+	first := sort.Search(len(o.stripes), func(i int) bool {
+		return int64(o.stripes[i].offset+o.stripes[i].size) > off
+	})
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(o.stripes))
+	for i := first; i < len(o.stripes) && int64(o.stripes[i].offset) < end; i++ {
+		stripe := &o.stripes[i]
+		lo := max(off, int64(stripe.offset))
+		hi := min(end, int64(stripe.offset+stripe.size))
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = o.readStripe(stripe, lo-int64(stripe.offset), hi-int64(stripe.offset), p[lo-off:hi-off])
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := int(end - off)
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readStripe reads the stripe relative range [lo, hi) into dst,
+// fetching only the covered ranges of the data shards.
+// Sealed shards can only be authenticated as a whole, so the covered data
+// shards of an encrypted object are fetched entirely.
+func (o *Object) readStripe(stripe *stripeLayout, lo, hi int64, dst []byte) error {
+	n := o.fs.K + o.fs.M
+	shards := o.shards[stripe.index*n : (stripe.index+1)*n]
+	shardSize := int64(stripe.shardSize)
+
+	var wg sync.WaitGroup
+	var failed bool
+	var mu sync.Mutex
+
+	for j := lo / shardSize; j*shardSize < hi; j++ {
+		shard := &shards[j]
+		from := max(lo, j*shardSize)
+		to := min(hi, (j+1)*shardSize)
+
+		server, ok := o.config.maps[shard.serverID]
+		if !ok || !server.reachable || shard.missing {
+			mu.Lock()
+			failed = true
+			mu.Unlock()
+			break
+		}
+
+		wg.Add(1)
+		go func(shard *Shard, from, to int64) {
+			defer wg.Done()
+			var err error
+			if o.fs.cipher != nil {
+				var data []byte
+				data, err = o.config.loadShard(context.Background(), o.fs, shard, stripe.shardSize)
+				if err == nil {
+					copy(dst[from-lo:to-lo], data[from-j*shardSize:to-j*shardSize])
+				}
+			} else {
+				err = readShardRange(server, shard, from-j*shardSize, dst[from-lo:to-lo])
+			}
+			if err != nil {
+				log.Warnf("retrieve range of shard %d error: %v", shard.shardIndex, err)
+				mu.Lock()
+				failed = true
+				mu.Unlock()
+			}
+		}(shard, from, to)
+	}
+	wg.Wait()
+
+	if !failed {
+		return nil
+	}
+
+	// missing data shards, fetch the whole stripe and reconstruct it
+	log.Infof("- stripe %d is degraded, begin to restore data", stripe.index)
+	data := o.config.fetchStripe(o.fs, shards, stripe.shardSize, nil)
+	if err := o.enc.ReconstructData(data); err != nil {
+		return fmt.Errorf("stripe %d has left us permanently: %v", stripe.index, err)
+	}
+
+	for j := lo / shardSize; j*shardSize < hi; j++ {
+		from := max(lo, j*shardSize)
+		to := min(hi, (j+1)*shardSize)
+		copy(dst[from-lo:to-lo], data[j][from-j*shardSize:to-j*shardSize])
+	}
+	return nil
+}
+
+func readShardRange(server *Server, shard *Shard, offset int64, dst []byte) error {
+	rc, err := server.GetShardStream(context.Background(), shard, offset, int64(len(dst)))
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	_, err = io.ReadFull(rc, dst)
+	return err
+}
+
+// Read reads from the current offset of the object
+func (o *Object) Read(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.closed {
+		return 0, errors.New("object is closed")
+	}
+
+	n, err := o.ReadAt(p, o.offset)
+	o.offset += int64(n)
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the offset for the next Read
+func (o *Object) Seek(offset int64, whence int) (int64, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.Size()
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	o.offset = offset
+	return offset, nil
+}
+
+// Close closes the object
+func (o *Object) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	return nil
+}
@@ -0,0 +1,367 @@
+package rnas
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// times to put a shard to a server before re-placing it
+	putAttempts = 3
+	// delay before the first retry, doubled every retry
+	putBackoff = 200 * time.Millisecond
+)
+
+// putSession is an object being put. Its metadata is kept in memory while
+// the shards are uploaded, and written in one transaction only when every
+// stripe reaches the write quorum, so that no write lock is held during
+// the upload. Otherwise the stored shards are deleted.
+type putSession struct {
+	ctx context.Context
+	c   *Config
+	fs  *FileStripe
+	enc reedsolomon.Encoder
+	// hashes the object in dedup mode
+	hash hash.Hash
+
+	mu     sync.Mutex
+	shards []Shard // shards to record on commit
+	stored []Shard // shards stored on the servers so far
+	pinned []Shard // deduplicated shards pinned until commit or rollback
+	err    error   // the first failure
+}
+
+func (c *Config) beginPut(ctx context.Context, fs *FileStripe) (*putSession, error) {
+	enc, err := reedsolomon.New(c.K, c.M)
+	if err != nil {
+		return nil, err
+	}
+
+	var prev *FileStripe
+	if c.Chunking != nil {
+		prev, _ = c.getObject(fs.Filepath)
+	}
+	if prev != nil && prev.WrappedKey != nil {
+		err = c.inheritObjectCipher(fs, prev)
+	} else {
+		err = c.newObjectCipher(fs)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the shards are stored under the directory of the ID
+	fs.ID, err = allocFileStripeID()
+	if err != nil {
+		return nil, err
+	}
+
+	p := &putSession{ctx: ctx, c: c, fs: fs, enc: enc}
+	if c.Dedup {
+		p.hash = sha256.New()
+	}
+	return p, nil
+}
+
+// reader returns the reader of the object to put, hashing it in dedup mode
+func (p *putSession) reader(r io.Reader) io.Reader {
+	if p.hash == nil {
+		return r
+	}
+	return io.TeeReader(r, p.hash)
+}
+
+// failed returns the first failure of the stripes put so far, or the
+// error of the context once it is done
+func (p *putSession) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	return p.ctx.Err()
+}
+
+// pin keeps the deduplicated shard file from being deleted by a concurrent
+// delete or rollback until the session ends
+func (p *putSession) pin(shard *Shard) {
+	if shard.contentHash == "" {
+		return
+	}
+	p.c.pinShards([]Shard{*shard})
+	p.mu.Lock()
+	p.pinned = append(p.pinned, *shard)
+	p.mu.Unlock()
+}
+
+// unpin releases the pins once the metadata is committed or rolled back
+func (p *putSession) unpin() {
+	p.mu.Lock()
+	pinned := p.pinned
+	p.pinned = nil
+	p.mu.Unlock()
+	p.c.unpinShards(pinned)
+}
+
+func (p *putSession) fail(err error) error {
+	if p.err == nil {
+		p.err = err
+	}
+	return err
+}
+
+// putStripe encodes the stripe and sends its shards to the slots. A shard
+// whose server keeps failing is re-placed on another server. It is safe to
+// put several stripes of the session concurrently.
+func (p *putSession) putStripe(stripeIndex int, data [][]byte) error {
+	c, fs := p.c, p.fs
+	n := fs.K + fs.M
+
+	// encode
+	log.Debug("- start to encode stripe")
+	now := time.Now()
+	err := p.enc.Encode(data)
+	end := time.Since(now)
+
+	if err != nil {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.fail(fmt.Errorf("bad encoding: %w", err))
+	}
+
+	log.Debugf("- encode stripe cost %v", end)
+
+	shards := make([]Shard, n)
+	ok := make([]bool, n)
+	counts := make(map[string]int)
+	for _, serverID := range c.slots {
+		counts[serverID]++
+	}
+	var countsMu sync.Mutex
+	var wg sync.WaitGroup
+
+	// send
+	for i := 0; i < n; i++ {
+		stored := fs.sealShard(data[i])
+		shards[i] = Shard{
+			fileID:        fs.ID,
+			shardIndex:    stripeIndex*n + i,
+			serverID:      c.slots[i],
+			shardHashname: hashMD5(stored),
+			dataShard:     i < fs.K,
+			size:          len(stored),
+		}
+		if c.Dedup {
+			shards[i].contentHash = hashSHA256(stored)
+		}
+
+		wg.Add(1)
+		go func(i int, shard *Shard, data []byte) {
+			defer wg.Done()
+			failed := make(map[string]bool)
+			for {
+				p.pin(shard)
+				if c.hasSharedShard(p.ctx, shard) {
+					log.Debugf("- shard %d is already stored on server[%s]", shard.shardIndex, shard.serverID)
+					ok[i] = true
+					return
+				}
+				if c.putShardWithRetry(p.ctx, shard, data) {
+					ok[i] = true
+					return
+				}
+				if p.ctx.Err() != nil {
+					return
+				}
+				failed[shard.serverID] = true
+
+				// re-place the shard on another server
+				countsMu.Lock()
+				counts[shard.serverID]--
+				server := c.pickServer(counts, func(s *Server) bool { return failed[s.Id] })
+				if server != nil {
+					counts[server.Id]++
+				}
+				countsMu.Unlock()
+
+				if server == nil {
+					log.Errorf("- no server left to place shard %d", shard.shardIndex)
+					return
+				}
+				log.Warnf("- re-place shard %d from server[%s] to server[%s]", shard.shardIndex, shard.serverID, server.Id)
+				shard.serverID = server.Id
+			}
+		}(i, &shards[i], stored)
+	}
+	wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	succeeded := 0
+	for i := range shards {
+		if ok[i] {
+			p.stored = append(p.stored, shards[i])
+			succeeded++
+		}
+	}
+
+	// the shards stored before the context is done are deleted by the
+	// rollback as well
+	if err := p.ctx.Err(); err != nil {
+		return p.fail(err)
+	}
+
+	if succeeded < c.writeQuorum() {
+		return p.fail(fmt.Errorf("%w: only %d/%d shards of stripe %d are stored, %d needed",
+			ErrWriteQuorum, succeeded, n, stripeIndex, c.writeQuorum()))
+	}
+	if succeeded < n {
+		log.Warnf("- stripe %d is degraded, %d/%d shards are stored", stripeIndex, succeeded, n)
+		p.fs.NeedsRepair = true
+	}
+
+	// the shards failed to store are recorded as missing, so that they are
+	// recovered by reading and repaired by scrubbing
+	for i := range shards {
+		shards[i].missing = !ok[i]
+	}
+	p.shards = append(p.shards, shards...)
+	return nil
+}
+
+// putShardWithRetry puts the shard to its server, retrying with backoff
+func (c *Config) putShardWithRetry(ctx context.Context, shard *Shard, data []byte) bool {
+	server := c.maps[shard.serverID]
+	backoff := putBackoff
+	for attempt := 1; ; attempt++ {
+		err := server.PutShard(ctx, shard, data)
+		if err == nil {
+			return true
+		}
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Errorf("error when put shard to server[%s] (attempt %d/%d): %v", server.Id, attempt, putAttempts, err)
+		if attempt == putAttempts {
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// commit writes the metadata of the object, which makes it visible in
+// place of the version stored at its path
+func (p *putSession) commit() error {
+	if p.hash != nil {
+		p.fs.ContentHash = hex.EncodeToString(p.hash.Sum(nil))
+	}
+
+	tx, err := _db.Begin()
+	if err != nil {
+		return p.rollback(fmt.Errorf("failed to begin transaction: %v", err))
+	}
+	prevID, prevShards, err := p.c.saveVersion(tx, p.fs, p.shards)
+	if err != nil {
+		tx.Rollback()
+		return p.rollback(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return p.rollback(fmt.Errorf("failed to commit transaction: %v", err))
+	}
+
+	// the committed shards keep their files now
+	p.unpin()
+	if prevID != 0 {
+		p.c.dropVersion(prevID, prevShards)
+	}
+	return nil
+}
+
+// rollback deletes the stored shards of the object, then returns the cause
+func (p *putSession) rollback(cause error) error {
+	log.Warnf("- roll back %s: %v", p.fs.Filepath, cause)
+
+	// the shards that other puts pin as well are kept
+	p.unpin()
+
+	pending, err := p.c.deleteShardFiles(p.fs.ID, p.stored)
+	if err != nil {
+		log.Errorf("- failed to delete stored shards: %v", err)
+	} else if pending > 0 {
+		log.Warnf("- %d paths are pending deletion", pending)
+	}
+	return cause
+}
+
+// saveVersion saves the object along with its shards and chunks in the
+// transaction, in place of the version stored at its path. It returns the
+// ID, 0 if none, and the shards of the replaced version, to be dropped
+// once the transaction is committed.
+func (c *Config) saveVersion(tx *sql.Tx, fs *FileStripe, shards []Shard) (int, []Shard, error) {
+	prevID, prevConfig, prevShards, err := deleteFileStripeByPath(tx, fs.Filepath)
+	if err != nil {
+		return 0, nil, err
+	}
+	// the shards of another config are on other servers
+	if prevID != 0 && prevConfig != c.Name {
+		return 0, nil, fmt.Errorf("%s is stored by config %s", fs.Filepath, prevConfig)
+	}
+
+	if err := saveFileStripe(tx, fs); err != nil {
+		return 0, nil, err
+	}
+	for i := range shards {
+		shards[i].fileID = fs.ID
+		if err := saveShard(tx, &shards[i]); err != nil {
+			return 0, nil, err
+		}
+	}
+	for i := range fs.chunks {
+		if err := saveChunk(tx, fs.ID, &fs.chunks[i]); err != nil {
+			return 0, nil, err
+		}
+	}
+	return prevID, prevShards, nil
+}
+
+// dropVersion deletes the shard files of a replaced version that the new
+// one no longer refers to
+func (c *Config) dropVersion(prevID int, shards []Shard) {
+	pending, err := c.deleteShardFiles(prevID, shards)
+	if err != nil {
+		log.Warnf("- failed to delete the shards of the replaced version: %v", err)
+	} else if pending > 0 {
+		log.Warnf("- %d paths of the replaced version are pending deletion", pending)
+	}
+}
+
+// splitStripe splits the data of a stripe into K data shards and M parity
+// shards, which are taken from the rest of buf if it is long enough, or
+// allocated otherwise
+func (c *Config) splitStripe(buf []byte, shardSize int) [][]byte {
+	data := make([][]byte, c.K+c.M)
+	for j := range data {
+		if j < c.K || len(buf) >= len(data)*shardSize {
+			data[j] = buf[j*shardSize : (j+1)*shardSize]
+		} else {
+			data[j] = make([]byte, shardSize)
+		}
+	}
+	return data
+}
@@ -0,0 +1,345 @@
+package rnas
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+	"github.com/yztz/rnas/storage"
+)
+
+func init() {
+	log.SetOutput(io.Discard)
+	storage.DriverInitializers["faulty"] = func() storage.StorageDriver { return &faultyDriver{} }
+}
+
+// faults are the failures injected into the writes of a faulty server
+type faults struct {
+	failCreate  atomic.Bool
+	blockCreate atomic.Bool
+	// signalled when a write blocks
+	blocked chan struct{}
+	// writes succeeded
+	created atomic.Int32
+
+	// the next delete blocks until released
+	blockDelete atomic.Bool
+	deleting    chan struct{}
+	release     chan struct{}
+}
+
+// faults of the faulty servers by their path
+var faultsByPath sync.Map
+
+// faultyDriver is a local driver whose writes fail or block on demand
+type faultyDriver struct {
+	storage.LocalDriver
+	faults *faults
+}
+
+func (d *faultyDriver) Init(s *storage.StorageConfig) error {
+	f, _ := faultsByPath.LoadOrStore(s.Path, &faults{
+		blocked:  make(chan struct{}, 64),
+		deleting: make(chan struct{}, 1),
+		release:  make(chan struct{}),
+	})
+	d.faults = f.(*faults)
+	return d.LocalDriver.Init(s)
+}
+
+func (d *faultyDriver) Create(path string, data []byte) error {
+	return d.CreateContext(context.Background(), path, data)
+}
+
+func (d *faultyDriver) CreateContext(ctx context.Context, path string, data []byte) error {
+	if d.faults.failCreate.Load() {
+		return errors.New("injected failure")
+	}
+	if d.faults.blockCreate.Load() {
+		select {
+		case d.faults.blocked <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	err := d.LocalDriver.CreateContext(ctx, path, data)
+	if err == nil {
+		d.faults.created.Add(1)
+	}
+	return err
+}
+
+func (d *faultyDriver) Delete(path string) error {
+	if d.faults.blockDelete.CompareAndSwap(true, false) {
+		d.faults.deleting <- struct{}{}
+		<-d.faults.release
+	}
+	return d.LocalDriver.Delete(path)
+}
+
+// newTestConfig returns a config of faulty servers s0, s1... on a fresh
+// database
+func newTestConfig(t *testing.T, k, m, tolerance, servers int) *Config {
+	t.Helper()
+	dir := t.TempDir()
+
+	db, err := sql.Open("sqlite3", filepath.Join(dir, "rnas.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err := InitDB(db); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		Name:         "test",
+		Tolerance:    tolerance,
+		StripeConfig: StripeConfig{K: k, M: m, MinDepth: 1024, StripeDepth: 4096},
+	}
+	for i := 0; i < servers; i++ {
+		id := fmt.Sprintf("s%d", i)
+		c.Servers = append(c.Servers, &Server{
+			Type:          "faulty",
+			Id:            id,
+			StorageConfig: storage.StorageConfig{Path: filepath.Join(dir, id)},
+		})
+	}
+	if err := c.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func serverFaults(server *Server) *faults {
+	f, _ := faultsByPath.Load(server.Path)
+	return f.(*faults)
+}
+
+func randomData(t *testing.T, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// storedFiles returns the number of files on the servers of the config
+func storedFiles(t *testing.T, c *Config) int {
+	t.Helper()
+	files := 0
+	for _, server := range c.Servers {
+		err := filepath.WalkDir(server.Path, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				files++
+			}
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+// assertRolledBack checks that neither metadata nor shard files are left
+func assertRolledBack(t *testing.T, c *Config, path string) {
+	t.Helper()
+	if _, err := c.Stat(path); err == nil {
+		t.Errorf("%s is visible after the rollback", path)
+	}
+	var shards int
+	if err := _db.QueryRow(`SELECT COUNT(*) FROM shards`).Scan(&shards); err != nil {
+		t.Fatal(err)
+	}
+	if shards != 0 {
+		t.Errorf("%d shard rows are left after the rollback", shards)
+	}
+	if files := storedFiles(t, c); files != 0 {
+		t.Errorf("%d shard files are left after the rollback", files)
+	}
+}
+
+func readAll(t *testing.T, c *Config, path string) []byte {
+	t.Helper()
+	obj, err := c.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPutQuorumFailureRollsBack(t *testing.T) {
+	c := newTestConfig(t, 2, 1, 1, 3)
+	serverFaults(c.Servers[2]).failCreate.Store(true)
+
+	data := randomData(t, 20000)
+	err := c.Put("/obj", int64(len(data)), bytes.NewReader(data))
+	if !errors.Is(err, ErrWriteQuorum) {
+		t.Fatalf("put returned %v, want %v", err, ErrWriteQuorum)
+	}
+	assertRolledBack(t, c, "/obj")
+}
+
+func TestPutCancelRollsBack(t *testing.T) {
+	c := newTestConfig(t, 2, 1, 1, 3)
+	f := serverFaults(c.Servers[2])
+	f.blockCreate.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// cancel once the other shards of a stripe are stored
+	go func() {
+		<-f.blocked
+		for serverFaults(c.Servers[0]).created.Load() == 0 || serverFaults(c.Servers[1]).created.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+
+	data := randomData(t, 20000)
+	err := c.PutContext(ctx, "/obj", int64(len(data)), bytes.NewReader(data))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("put returned %v, want %v", err, context.Canceled)
+	}
+	assertRolledBack(t, c, "/obj")
+}
+
+func TestScrubRepairsDegradedPut(t *testing.T) {
+	// s0 holds 2 shards of every stripe and s1 has room for one more, the
+	// shards of s2 and s3 fail on s2, s3 and s4 and only one finds room
+	c := newTestConfig(t, 3, 2, 1, 5)
+	c.WriteQuorum = 4
+	for _, server := range c.Servers[2:] {
+		serverFaults(server).failCreate.Store(true)
+	}
+
+	data := randomData(t, 20000)
+	if err := c.Put("/obj", int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatalf("degraded put failed: %v", err)
+	}
+	if !bytes.Equal(readAll(t, c, "/obj"), data) {
+		t.Fatal("degraded object reads back wrong")
+	}
+	stat, err := c.Stat("/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Health != HealthDegraded || !stat.NeedsRepair {
+		t.Fatalf("degraded object is %s, needs repair: %v", stat.Health, stat.NeedsRepair)
+	}
+
+	for _, server := range c.Servers[2:] {
+		serverFaults(server).failCreate.Store(false)
+	}
+
+	report, err := c.Scrub(ScrubOptions{Repair: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj, err := c.getObject("/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripes := len(obj.layout())
+	if len(report.BadShards) != stripes || report.Unrepaired() != 0 {
+		t.Fatalf("scrub found %d bad shards with %d unrepaired, want %d repaired",
+			len(report.BadShards), report.Unrepaired(), stripes)
+	}
+
+	report, err = c.Scrub(ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.BadShards) != 0 {
+		t.Fatalf("%d bad shards are left after the repair", len(report.BadShards))
+	}
+	if !bytes.Equal(readAll(t, c, "/obj"), data) {
+		t.Fatal("repaired object reads back wrong")
+	}
+	stat, err = c.Stat("/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.Health != HealthHealthy || stat.NeedsRepair {
+		t.Fatalf("repaired object is %s, needs repair: %v", stat.Health, stat.NeedsRepair)
+	}
+}
+
+func TestPutReplacesVersion(t *testing.T) {
+	c := newTestConfig(t, 2, 1, 1, 3)
+	for i := 0; i < 2; i++ {
+		data := randomData(t, 20000)
+		if err := c.Put("/obj", int64(len(data)), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	obj, err := c.getObject("/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := len(obj.layout()) * (c.K + c.M)
+	if files := storedFiles(t, c); files != want {
+		t.Fatalf("%d shard files are stored, want %d of the new version", files, want)
+	}
+
+	if err := c.Delete("/missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("delete of a missing object returned %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestPutsRunConcurrently(t *testing.T) {
+	c := newTestConfig(t, 2, 1, 1, 3)
+	data := randomData(t, 20000)
+	stripe := c.StripeDepth * c.K
+
+	// a put stalled after storing its first stripe
+	r, w := io.Pipe()
+	stalled := make(chan error, 1)
+	go func() { stalled <- c.Put("/slow", int64(len(data)), r) }()
+	if _, err := w.Write(data[:stripe]); err != nil {
+		t.Fatal(err)
+	}
+	for serverFaults(c.Servers[0]).created.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := c.Put("/fast", int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatalf("put beside a put in progress failed: %v", err)
+	}
+	if _, err := c.Stat("/slow"); err == nil {
+		t.Error("/slow is visible before its put is done")
+	}
+
+	if _, err := w.Write(data[stripe:]); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if err := <-stalled; err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/slow", "/fast"} {
+		if !bytes.Equal(readAll(t, c, path), data) {
+			t.Fatalf("%s reads back wrong", path)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package rnas
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestReadStreamCloseStopsReads(t *testing.T) {
+	c := newTestConfig(t, 2, 1, 1, 3)
+	c.MaxInflightStripes = 2
+	data := randomData(t, 200000)
+	if err := c.Put("/obj", int64(len(data)), bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	stream, err := c.ReadStream("/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 1000)
+	if _, err := io.ReadFull(stream, head); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(head, data[:len(head)]) {
+		t.Fatal("stream reads back wrong")
+	}
+	if err := stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines are left after closing the stream", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
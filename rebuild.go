@@ -0,0 +1,193 @@
+package rnas
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sirupsen/logrus"
+)
+
+// Rebuild regenerates every shard that lived on the lost server and
+// re-layouts it onto the other healthy servers, so that the objects
+// get back to full redundancy.
+func (c *Config) Rebuild(serverID string) error {
+	log.Infof("Rebuild shards of server[%s]", serverID)
+
+	enc, err := reedsolomon.New(c.K, c.M)
+	if err != nil {
+		return err
+	}
+
+	files, err := getFileStripes(c.Name, "")
+	if err != nil {
+		return err
+	}
+
+	rebuilt, failed, failedFiles := 0, 0, 0
+	for _, fs := range files {
+		r, f, err := c.rebuildFile(enc, fs, serverID)
+		rebuilt += r
+		failed += f
+		if err != nil {
+			log.Errorf("- failed to rebuild %s: %v", fs.Filepath, err)
+			failedFiles++
+		}
+	}
+
+	log.Infof("Rebuild done, %d shards rebuilt, %d stripes and %d objects failed", rebuilt, failed, failedFiles)
+	if failed > 0 || failedFiles > 0 {
+		return fmt.Errorf("%d stripes and %d objects of server[%s] could not be rebuilt", failed, failedFiles, serverID)
+	}
+	return nil
+}
+
+// rebuildFile rebuilds the lost shards of one object, returning the number
+// of rebuilt shards and failed stripes
+func (c *Config) rebuildFile(enc reedsolomon.Encoder, fs *FileStripe, lost string) (int, int, error) {
+	if fs.K != c.K || fs.M != c.M {
+		return 0, 0, fmt.Errorf("object is striped with %d + %d, but config is %d + %d", fs.K, fs.M, c.K, c.M)
+	}
+
+	err := c.loadObjectCipher(fs)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	allShards, err := getShards(fs.ID)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	n := fs.K + fs.M
+	stripes := fs.layout()
+	if len(allShards) != len(stripes)*n {
+		return 0, 0, fmt.Errorf("bad shards number: %d", len(allShards))
+	}
+
+	isLost := func(shard *Shard) bool { return shard.serverID == lost }
+	never := func(*Shard) bool { return false }
+
+	rebuilt, failed := 0, 0
+	for _, stripe := range stripes {
+		shards := allShards[stripe.index*n : (stripe.index+1)*n]
+
+		numLost := 0
+		for j := range shards {
+			if isLost(&shards[j]) {
+				numLost++
+			}
+		}
+		if numLost == 0 {
+			continue
+		}
+
+		log.Debugf("- rebuild %d shards of stripe %d of %s", numLost, stripe.index, fs.Filepath)
+		r, err := c.repairStripe(enc, fs, shards, stripe.shardSize, isLost, never)
+		rebuilt += r
+		if err != nil {
+			log.Errorf("- failed to rebuild stripe %d of %s: %v", stripe.index, fs.Filepath, err)
+			failed++
+		}
+	}
+
+	return rebuilt, failed, nil
+}
+
+// repairStripe reconstructs the bad shards of a stripe from the other ones
+// and puts them back. A bad shard is rewritten to its own server when
+// inPlace allows, otherwise it is re-placed onto another server without
+// breaking the tolerance. It returns the number of repaired shards.
+func (c *Config) repairStripe(enc reedsolomon.Encoder, fs *FileStripe, shards []Shard, shardSize int,
+	bad func(*Shard) bool, inPlace func(*Shard) bool) (int, error) {
+	data := c.fetchStripe(fs, shards, shardSize, bad)
+	if err := enc.Reconstruct(data); err != nil {
+		return 0, fmt.Errorf("failed to reconstruct: %v", err)
+	}
+
+	counts := make(map[string]int)
+	excluded := make(map[string]bool)
+	for j := range shards {
+		shard := &shards[j]
+		if !bad(shard) || inPlace(shard) {
+			counts[shard.serverID]++
+		} else {
+			excluded[shard.serverID] = true
+		}
+	}
+
+	repaired := 0
+	for j := range shards {
+		shard := &shards[j]
+		if !bad(shard) {
+			continue
+		}
+		stored := fs.sealShard(data[j])
+		if hashMD5(stored) != shard.shardHashname {
+			return repaired, fmt.Errorf("reconstructed shard %d mismatches its hash %s", shard.shardIndex, shard.shardHashname)
+		}
+
+		var server *Server
+		if inPlace(shard) {
+			server = c.maps[shard.serverID]
+			// drop the bad copy before rewriting it
+			if err := server.Delete(c.shardPath(shard)); err != nil {
+				log.Warnf("- failed to delete bad shard %d from server[%s]: %v", shard.shardIndex, server.Id, err)
+			}
+		} else {
+			server = c.pickServer(counts, func(s *Server) bool { return excluded[s.Id] })
+			if server == nil {
+				return repaired, fmt.Errorf("no server can hold shard %d without breaking the tolerance", shard.shardIndex)
+			}
+		}
+
+		if err := server.PutShard(context.Background(), shard, stored); err != nil {
+			return repaired, fmt.Errorf("failed to put shard %d to server[%s]: %v", shard.shardIndex, server.Id, err)
+		}
+		missing := shard.missing
+		shard.missing = false
+		if server.Id != shard.serverID {
+			if err := c.moveShard(shard, server.Id); err != nil {
+				return repaired, err
+			}
+			counts[server.Id]++
+		} else if missing {
+			if err := updateShardServer(_db, shard); err != nil {
+				return repaired, err
+			}
+		}
+		repaired++
+	}
+
+	return repaired, nil
+}
+
+// moveShard records the shard on its new server, and the copy left on the
+// old one as pending deletion, as the old server may come back
+func (c *Config) moveShard(shard *Shard, serverID string) error {
+	tx, err := _db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	path := c.shardPath(shard)
+	if err := savePendingDeletion(tx, c.Name, shard.serverID, path); err != nil {
+		return err
+	}
+	// the shard may be moved back onto a server it was moved off before
+	if err := cancelPendingDeletion(tx, c.Name, serverID, path); err != nil {
+		return err
+	}
+	moved := *shard
+	moved.serverID = serverID
+	if err := updateShardServer(tx, &moved); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+
+	shard.serverID = serverID
+	return nil
+}
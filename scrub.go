@@ -0,0 +1,246 @@
+package rnas
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/reedsolomon"
+	log "github.com/sirupsen/logrus"
+)
+
+type ShardProblem string
+
+const (
+	// the shard file doesn't exist or cannot be read
+	ShardMissing ShardProblem = "missing"
+	// the shard file mismatches its hash
+	ShardCorrupt ShardProblem = "corrupt"
+	// the server of the shard is unreachable or removed
+	ShardUnreachable ShardProblem = "unreachable"
+)
+
+type ScrubOptions struct {
+	// scrub only this object, all objects of the config when empty
+	Filepath string
+	// only check that the shard files exist, without reading them
+	Quick bool
+	// reconstruct and rewrite the bad shards
+	Repair bool
+}
+
+type BadShard struct {
+	Filepath   string
+	ShardIndex int
+	ServerID   string
+	Problem    ShardProblem
+	Repaired   bool
+}
+
+type ScrubReport struct {
+	Objects   int
+	Shards    int
+	BadShards []BadShard
+	// objects that could not be scrubbed
+	Failed map[string]error
+}
+
+// PerServer counts the bad shards of every server
+func (r *ScrubReport) PerServer() map[string]int {
+	counts := make(map[string]int)
+	for _, bad := range r.BadShards {
+		counts[bad.ServerID]++
+	}
+	return counts
+}
+
+// PerObject counts the bad shards of every object
+func (r *ScrubReport) PerObject() map[string]int {
+	counts := make(map[string]int)
+	for _, bad := range r.BadShards {
+		counts[bad.Filepath]++
+	}
+	return counts
+}
+
+// Unrepaired counts the bad shards left
+func (r *ScrubReport) Unrepaired() int {
+	left := 0
+	for _, bad := range r.BadShards {
+		if !bad.Repaired {
+			left++
+		}
+	}
+	return left
+}
+
+// Scrub verifies the shards of the objects against the storages, and
+// optionally repairs the bad ones
+func (c *Config) Scrub(opts ScrubOptions) (*ScrubReport, error) {
+	log.Infof("Scrub objects of config %s", c.Name)
+
+	var files []*FileStripe
+	if opts.Filepath != "" {
+		fs, err := c.getObject(opts.Filepath)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, fs)
+	} else {
+		var err error
+		files, err = getFileStripes(c.Name, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report := &ScrubReport{Failed: make(map[string]error)}
+	for _, fs := range files {
+		left := report.Unrepaired()
+		err := c.scrubFile(fs, opts, report)
+		if err != nil {
+			log.Errorf("- failed to scrub %s: %v", fs.Filepath, err)
+			report.Failed[fs.Filepath] = err
+		}
+		report.Objects++
+
+		// the object flagged by fsck is sound again
+		if err == nil && !opts.Quick && fs.NeedsRepair && report.Unrepaired() == left {
+			if err := setNeedsRepair(fs.ID, false); err != nil {
+				log.Warnf("- failed to clear the repair flag of %s: %v", fs.Filepath, err)
+			}
+		}
+	}
+
+	log.Infof("Scrub done, %d objects, %d shards checked, %d bad, %d left",
+		report.Objects, report.Shards, len(report.BadShards), report.Unrepaired())
+	return report, nil
+}
+
+func (c *Config) scrubFile(fs *FileStripe, opts ScrubOptions, report *ScrubReport) error {
+	log.Debugf("- scrub %s", fs.Filepath)
+
+	allShards, err := getShards(fs.ID)
+	if err != nil {
+		return err
+	}
+
+	n := fs.K + fs.M
+	stripes := fs.layout()
+	if len(allShards) != len(stripes)*n {
+		return fmt.Errorf("bad shards number: %d", len(allShards))
+	}
+
+	// the size of sealed shards is needed even without repairing
+	if err := c.loadObjectCipher(fs); err != nil {
+		return err
+	}
+
+	var enc reedsolomon.Encoder
+	if opts.Repair {
+		enc, err = reedsolomon.New(fs.K, fs.M)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, stripe := range stripes {
+		shards := allShards[stripe.index*n : (stripe.index+1)*n]
+		problems := c.checkStripe(fs, shards, stripe.shardSize, opts.Quick)
+		report.Shards += len(shards)
+		if len(problems) == 0 {
+			continue
+		}
+
+		first := len(report.BadShards)
+		for j := range shards {
+			problem, ok := problems[j]
+			if !ok {
+				continue
+			}
+			shard := &shards[j]
+			log.Warnf("- shard %d of %s on server[%s] is %s", shard.shardIndex, fs.Filepath, shard.serverID, problem)
+			report.BadShards = append(report.BadShards, BadShard{
+				Filepath:   fs.Filepath,
+				ShardIndex: shard.shardIndex,
+				ServerID:   shard.serverID,
+				Problem:    problem,
+			})
+		}
+
+		if !opts.Repair {
+			continue
+		}
+
+		isBad := func(shard *Shard) bool {
+			_, ok := problems[shard.shardIndex-stripe.index*n]
+			return ok
+		}
+		inPlace := func(shard *Shard) bool {
+			return problems[shard.shardIndex-stripe.index*n] != ShardUnreachable
+		}
+		_, err := c.repairStripe(enc, fs, shards, stripe.shardSize, isBad, inPlace)
+		if err != nil {
+			log.Errorf("- failed to repair stripe %d of %s: %v", stripe.index, fs.Filepath, err)
+			continue
+		}
+		for i := first; i < len(report.BadShards); i++ {
+			report.BadShards[i].Repaired = true
+		}
+	}
+
+	return nil
+}
+
+// checkStripe checks every shard of the stripe in parallel, returning
+// the problems by the index of the shard in the stripe
+func (c *Config) checkStripe(fs *FileStripe, shards []Shard, shardSize int, quick bool) map[int]ShardProblem {
+	problems := make(map[int]ShardProblem)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for j := range shards {
+		wg.Add(1)
+		go func(j int, shard *Shard) {
+			defer wg.Done()
+			problem := c.checkShard(fs, shard, shardSize, quick)
+			if problem == "" {
+				return
+			}
+			mu.Lock()
+			problems[j] = problem
+			mu.Unlock()
+		}(j, &shards[j])
+	}
+	wg.Wait()
+
+	return problems
+}
+
+func (c *Config) checkShard(fs *FileStripe, shard *Shard, shardSize int, quick bool) ShardProblem {
+	server, ok := c.maps[shard.serverID]
+	if !ok || !server.reachable {
+		return ShardUnreachable
+	}
+	if shard.missing {
+		return ShardMissing
+	}
+
+	if quick {
+		if err := server.driver.Find(c.shardPath(shard)); err != nil {
+			return ShardMissing
+		}
+		return ""
+	}
+
+	data := make([]byte, fs.storedShardSize(shardSize))
+	n, err := server.GetShard(context.Background(), shard, data)
+	if err != nil {
+		log.Debugf("- retrieve shard %d error: %v", shard.shardIndex, err)
+		return ShardMissing
+	}
+	if n != len(data) || hashMD5(data) != shard.shardHashname {
+		return ShardCorrupt
+	}
+	return ""
+}
@@ -1,8 +1,11 @@
 package rnas
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"path/filepath"
 	"strconv"
 	"sync"
@@ -20,40 +23,54 @@ type Server struct {
 	Id       string `json:"id"`
 	UploadBandwidth float64 `json:"uploadBandwidth,omitempty"`
 	DownloadBandwidth float64 `json:"downloadBandwidth,omitempty"`
+	// MaxConns bounds the concurrent shard transfers with the server,
+	// unlimited when zero
+	MaxConns int `json:"maxConns,omitempty"`
 	storage.StorageConfig
 	
-	driver storage.StorageDriver
+	driver storage.ContextDriver
 	mu sync.Mutex
 	config *Config
 	reachable bool
-}
+	conns chan struct{}
 
-func (server *Server) Init(config *Config) {
-	var t string
+	// throughput observed from shard reads, see observeDownload
+	statsMu sync.Mutex
+	observedDownload float64
+}
 
+func (server *Server) Init(config *Config) error {
 	initFunc, ok := storage.DriverInitializers[server.Type]
 	if !ok {
-		log.Fatalf("Unsupported driver type: %s\n", t)
+		return fmt.Errorf("%w: %s", ErrUnsupportedDriver, server.Type)
 	}
 	server.config = config
 
+	if server.MaxConns < 0 {
+		return fmt.Errorf("%w: maxConns of server[%s] is negative", ErrInvalidConfig, server.Id)
+	}
+	if server.MaxConns > 0 {
+		server.conns = make(chan struct{}, server.MaxConns)
+	}
+
 	driver := initFunc()
 	err := driver.Init(&server.StorageConfig)
 	if err != nil {
-		log.Errorf("Failed to initialize driver for server: %s", server.Id)
+		log.Errorf("Failed to initialize driver for server: %s, because: %v", server.Id, err)
 		server.reachable = false
-		return
+		return nil
 	}
-	server.driver = driver
+	server.driver = storage.WithContext(driver)
 	server.reachable = true
 
 	err = server.driver.Mkdir(config.Name)
 	// err := server.TestSpeed()
 	if err != nil {
-		log.Fatalf("Failed to init config sub-folder, because: %v", err)
+		log.Errorf("Failed to init config sub-folder for server: %s, because: %v", server.Id, err)
+		server.reachable = false
 	}
 
-	
+	return nil
 }
 
 // testServer performs upload and download speed tests based on server type
@@ -96,20 +113,77 @@ func (server *Server) TestSpeed() error {
 }
 
 
-func (server *Server) PutShard(shard *Shard, data []byte) error {
-	// server.mu.Lock()
-	// defer server.mu.Unlock()
+// fileDir returns the directory holding the shards of a file
+func (c *Config) fileDir(fileID int) string {
+	return filepath.Join(c.Name, strconv.Itoa(fileID))
+}
+
+// shardDir returns the directory holding a shard, the content-addressed
+// store for a deduplicated one
+func (c *Config) shardDir(shard *Shard) string {
+	if shard.contentHash != "" {
+		return c.casDir()
+	}
+	return c.fileDir(shard.fileID)
+}
 
-	prefix := filepath.Join(server.config.Name, strconv.Itoa(shard.fileID))
+// shardPath returns the path of a shard
+func (c *Config) shardPath(shard *Shard) string {
+	if shard.contentHash != "" {
+		return filepath.Join(c.casDir(), fmt.Sprintf("%s.%s", shard.contentHash, fakeSuffix))
+	}
 	shardName := fmt.Sprintf("%s.%s", shard.shardHashname, fakeSuffix)
-	err := server.driver.Mkdir(prefix)
+	return filepath.Join(c.fileDir(shard.fileID), shardName)
+}
+
+// acquire takes a connection to the server, waiting while MaxConns
+// connections are in use
+func (server *Server) acquire(ctx context.Context) error {
+	if server.conns == nil {
+		return nil
+	}
+	select {
+	case server.conns <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (server *Server) release() {
+	if server.conns != nil {
+		<-server.conns
+	}
+}
+
+// releaseReadCloser releases the connection of a stream when it is closed
+type releaseReadCloser struct {
+	io.ReadCloser
+	once sync.Once
+	server *Server
+}
+
+func (r *releaseReadCloser) Close() error {
+	r.once.Do(r.server.release)
+	return r.ReadCloser.Close()
+}
+
+func (server *Server) PutShard(ctx context.Context, shard *Shard, data []byte) error {
+	if err := server.acquire(ctx); err != nil {
+		return err
+	}
+	defer server.release()
+
+	err := server.driver.MkdirContext(ctx, server.config.shardDir(shard))
 	if err != nil {
 		return err
 	}
 
 	now := time.Now()
 	log.Debugf("- start to transfer shard %d with size %d to server[%s]", shard.shardIndex, len(data),shard.serverID)
-	err = server.driver.Create(filepath.Join(prefix, shardName), data)
+	// drivers write under a temporary name and rename into place, so the
+	// shard is complete once created and may be recorded
+	err = server.driver.CreateContext(ctx, server.config.shardPath(shard), data)
 	if err != nil {
 		return err
 	}
@@ -118,42 +192,81 @@ func (server *Server) PutShard(shard *Shard, data []byte) error {
 	return nil
 }
 
-func (server *Server) GetShard(shard *Shard, data []byte) (int, error) {
-	// server.mu.Lock()
-	// defer server.mu.Unlock()
-
-	prefix := filepath.Join(server.config.Name, strconv.Itoa(shard.fileID))
-	shardName := fmt.Sprintf("%s.%s", shard.shardHashname, fakeSuffix)
+func (server *Server) GetShard(ctx context.Context, shard *Shard, data []byte) (int, error) {
+	if err := server.acquire(ctx); err != nil {
+		return 0, err
+	}
+	defer server.release()
 
 	start := time.Now()
-	n,err := server.driver.Read(filepath.Join(prefix, shardName), 0, data)
+	n,err := server.driver.ReadContext(ctx, server.config.shardPath(shard), 0, data)
 	end := time.Since(start)
 	if err != nil {
 		return n, err
 	}
 
 	log.Debugf("- transfer shard %d done, size %d/%d, took %v", shard.shardIndex, n, len(data), end)
+	server.observeDownload(n, end)
 
 	return n,err
 }
 
 
-func (server *Server) GetShardStream(shard *Shard, offset int64, length int64) (io.ReadCloser, error) {
-	// server.mu.Lock()
-	// defer server.mu.Unlock()
-
-	prefix := filepath.Join(server.config.Name, strconv.Itoa(shard.fileID))
-	shardName := fmt.Sprintf("%s.%s", shard.shardHashname, fakeSuffix)
+func (server *Server) GetShardStream(ctx context.Context, shard *Shard, offset int64, length int64) (io.ReadCloser, error) {
+	if err := server.acquire(ctx); err != nil {
+		return nil, err
+	}
 
-	n,err := server.driver.ReadStream(filepath.Join(prefix, shardName), offset, length)
+	n,err := server.driver.ReadStreamContext(ctx, server.config.shardPath(shard), offset, length)
 
 	if err != nil {
+		server.release()
 		return nil, err
 	}
 
-	return n,err
+	return &releaseReadCloser{ReadCloser: n, server: server}, nil
+}
+
+// Delete deletes a file or an empty directory, deleting a missing one succeeds
+func (server *Server) Delete(path string) error {
+	if !server.reachable {
+		return fmt.Errorf("server[%s] is unreachable", server.Id)
+	}
+
+	err := server.driver.Delete(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
 }
 
+// observeDownload records the throughput of a shard read, smoothed with
+// the reads before
+func (server *Server) observeDownload(n int, took time.Duration) {
+	if n == 0 || took <= 0 {
+		return
+	}
+	speed := float64(n) / took.Seconds()
+
+	server.statsMu.Lock()
+	defer server.statsMu.Unlock()
+	if server.observedDownload == 0 {
+		server.observedDownload = speed
+	} else {
+		server.observedDownload = 0.7 * server.observedDownload + 0.3 * speed
+	}
+}
+
+// downloadThroughput returns the observed throughput of the server, or the
+// tested bandwidth before any shard is read from it, 0 if both are unknown
+func (server *Server) downloadThroughput() float64 {
+	server.statsMu.Lock()
+	defer server.statsMu.Unlock()
+	if server.observedDownload != 0 {
+		return server.observedDownload
+	}
+	return server.DownloadBandwidth
+}
 
 type Servers []*Server
 
@@ -0,0 +1,97 @@
+package rnas
+
+type Health string
+
+const (
+	// all shards are on reachable servers
+	HealthHealthy Health = "healthy"
+	// some shards are unavailable, but every stripe can be reconstructed
+	HealthDegraded Health = "degraded"
+	// some stripes cannot be reconstructed
+	HealthLost Health = "lost"
+)
+
+// ObjectStat is the status of a stored object
+type ObjectStat struct {
+	FileStripe
+
+	Stripes      int
+	Distribution map[string]int // number of shards on every server
+	MinAvailable int            // min number of shards of a stripe on reachable servers
+	Health       Health
+}
+
+// List lists the objects of the config whose path starts with the prefix
+func (c *Config) List(prefix string) ([]*ObjectStat, error) {
+	files, err := getFileStripes(c.Name, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := getShardsByPrefix(c.Name, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := make([]*ObjectStat, 0, len(files))
+	for _, fs := range files {
+		stats = append(stats, c.objectStat(fs, shards[fs.ID]))
+	}
+	return stats, nil
+}
+
+// Stat returns the status of the object
+func (c *Config) Stat(filepath string) (*ObjectStat, error) {
+	fs, err := c.getObject(filepath)
+	if err != nil {
+		return nil, err
+	}
+
+	shards, err := getShards(fs.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.objectStat(fs, shards), nil
+}
+
+func (c *Config) objectStat(fs *FileStripe, shards []Shard) *ObjectStat {
+	n := fs.K + fs.M
+	stat := &ObjectStat{
+		FileStripe:   *fs,
+		Stripes:      len(fs.layout()),
+		Distribution: make(map[string]int),
+		MinAvailable: n,
+	}
+
+	available := make([]int, stat.Stripes)
+	for i := range shards {
+		shard := &shards[i]
+		if shard.missing {
+			continue
+		}
+		stat.Distribution[shard.serverID]++
+
+		stripeIndex := shard.shardIndex / n
+		if stripeIndex >= stat.Stripes {
+			continue
+		}
+		if server, ok := c.maps[shard.serverID]; ok && server.reachable {
+			available[stripeIndex]++
+		}
+	}
+
+	for _, a := range available {
+		stat.MinAvailable = min(stat.MinAvailable, a)
+	}
+
+	switch {
+	case stat.MinAvailable == n:
+		stat.Health = HealthHealthy
+	case stat.MinAvailable >= fs.K:
+		stat.Health = HealthDegraded
+	default:
+		stat.Health = HealthLost
+	}
+	return stat
+}
@@ -0,0 +1,83 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// TempPrefix starts the names of the files being written. Drivers write a
+// file under a temporary name and rename it into place once complete, so a
+// file is never seen truncated under its final name. Temporary files left
+// by interrupted writes are removed by a sweep.
+const TempPrefix = ".rnas-tmp-"
+
+// IsTemp tells the base name of a temporary file
+func IsTemp(name string) bool {
+	return strings.HasPrefix(name, TempPrefix)
+}
+
+// tempPath returns a unique temporary path next to p
+func tempPath(p string) string {
+	var suffix [8]byte
+	rand.Read(suffix[:])
+	dir, base := path.Split(strings.ReplaceAll(p, "\\", "/"))
+	return dir + TempPrefix + base + "." + hex.EncodeToString(suffix[:])
+}
+
+// writeFileAtomic writes a local file through a synced temporary file
+func writeFileAtomic(fullPath string, data []byte) (err error) {
+	dir, base := filepath.Split(fullPath)
+	file, err := os.CreateTemp(dir, TempPrefix+base+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			file.Close()
+			os.Remove(file.Name())
+		}
+	}()
+
+	if err := file.Chmod(0644); err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file.Name(), fullPath); err != nil {
+		return err
+	}
+
+	// persist the rename, not supported everywhere
+	if d, err := os.Open(filepath.Clean(dir)); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// renameInto publishes a temporary file written by create, which is deleted
+// if anything fails
+func renameInto(p string, create func(tmp string) error, rename func(tmp, p string) error, remove func(tmp string) error) error {
+	tmp := tempPath(p)
+	if err := create(tmp); err != nil {
+		remove(tmp)
+		return err
+	}
+	if err := rename(tmp, p); err != nil {
+		remove(tmp)
+		return fmt.Errorf("failed to rename into place: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnsupported is returned when a driver lacks an optional capability
+var ErrUnsupported = errors.New("unsupported by the storage")
+
+// FileInfo describes a file or a directory of a storage
+type FileInfo struct {
+	// base name of the file
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir,omitempty"`
+}
+
+// Drivers may implement the optional capabilities below, which are reached
+// through the functions of the same names
+
+// Stater is a driver able to describe a file
+type Stater interface {
+	Stat(path string) (FileInfo, error)
+}
+
+// Lister is a driver able to enumerate a directory
+type Lister interface {
+	// List returns the files and directories directly under dir
+	List(dir string) ([]FileInfo, error)
+}
+
+// Renamer is a driver able to rename a file, replacing the destination
+type Renamer interface {
+	Rename(src, dst string) error
+}
+
+// UsageReporter is a driver able to report its capacity
+type UsageReporter interface {
+	// Usage returns the bytes used and free, -1 when unknown
+	Usage() (used, free int64, err error)
+}
+
+// capability returns the driver as T, looking through the context adapter
+func capability[T any](d StorageDriver) (T, bool) {
+	if a, ok := d.(*contextAdapter); ok {
+		d = a.StorageDriver
+	}
+	t, ok := d.(T)
+	return t, ok
+}
+
+// Stat describes a file of the driver
+func Stat(d StorageDriver, path string) (FileInfo, error) {
+	s, ok := capability[Stater](d)
+	if !ok {
+		return FileInfo{}, fmt.Errorf("stat: %w", ErrUnsupported)
+	}
+	return s.Stat(path)
+}
+
+// List enumerates a directory of the driver
+func List(d StorageDriver, dir string) ([]FileInfo, error) {
+	l, ok := capability[Lister](d)
+	if !ok {
+		return nil, fmt.Errorf("list: %w", ErrUnsupported)
+	}
+	return l.List(dir)
+}
+
+// Rename renames a file of the driver, replacing the destination
+func Rename(d StorageDriver, src, dst string) error {
+	r, ok := capability[Renamer](d)
+	if !ok {
+		return fmt.Errorf("rename: %w", ErrUnsupported)
+	}
+	return r.Rename(src, dst)
+}
+
+// Usage reports the capacity of the driver
+func Usage(d StorageDriver) (used, free int64, err error) {
+	u, ok := capability[UsageReporter](d)
+	if !ok {
+		return -1, -1, fmt.Errorf("usage: %w", ErrUnsupported)
+	}
+	return u.Usage()
+}
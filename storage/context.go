@@ -0,0 +1,135 @@
+package storage
+
+import (
+	"context"
+	"io"
+)
+
+// ContextDriver is a StorageDriver whose operations can be cancelled or
+// timed out with a context
+type ContextDriver interface {
+	StorageDriver
+	ReadContext(ctx context.Context, path string, offset int64, data []byte) (int, error)
+	ReadStreamContext(ctx context.Context, path string, offset int64, length int64) (io.ReadCloser, error)
+	CreateContext(ctx context.Context, path string, data []byte) error
+	FindContext(ctx context.Context, path string) error
+	DeleteContext(ctx context.Context, path string) error
+	MkdirContext(ctx context.Context, path string) error
+}
+
+// WithContext returns the driver itself if it supports contexts, or wraps
+// it with an adapter otherwise
+func WithContext(d StorageDriver) ContextDriver {
+	if cd, ok := d.(ContextDriver); ok {
+		return cd
+	}
+	return &contextAdapter{d}
+}
+
+// contextAdapter gives up waiting for an operation of a legacy driver once
+// the context is done. The operation itself cannot be interrupted and
+// still runs to the end in the background.
+type contextAdapter struct {
+	StorageDriver
+}
+
+// wait calls f, returning early with the error of ctx once it is done
+func wait(ctx context.Context, f func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *contextAdapter) ReadContext(ctx context.Context, path string, offset int64, data []byte) (int, error) {
+	// read into a buffer of our own, which may still be written after an
+	// early return
+	var n int
+	buf := make([]byte, len(data))
+	err := wait(ctx, func() error {
+		var err error
+		n, err = a.Read(path, offset, buf)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return copy(data, buf[:n]), nil
+}
+
+func (a *contextAdapter) ReadStreamContext(ctx context.Context, path string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		rc  io.ReadCloser
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rc, err := a.ReadStream(path, offset, length)
+		done <- result{rc, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return ContextReadCloser(ctx, r.rc), nil
+	case <-ctx.Done():
+		// close the stream nobody will read
+		go func() {
+			if r := <-done; r.rc != nil {
+				r.rc.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+func (a *contextAdapter) CreateContext(ctx context.Context, path string, data []byte) error {
+	return wait(ctx, func() error { return a.Create(path, data) })
+}
+
+func (a *contextAdapter) FindContext(ctx context.Context, path string) error {
+	return wait(ctx, func() error { return a.Find(path) })
+}
+
+func (a *contextAdapter) DeleteContext(ctx context.Context, path string) error {
+	return wait(ctx, func() error { return a.Delete(path) })
+}
+
+func (a *contextAdapter) MkdirContext(ctx context.Context, path string) error {
+	return wait(ctx, func() error { return a.Mkdir(path) })
+}
+
+type contextReadCloser struct {
+	ctx context.Context
+	io.ReadCloser
+}
+
+// ContextReadCloser returns a ReadCloser failing with the error of ctx
+// once it is done
+func ContextReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return &contextReadCloser{ctx, rc}
+}
+
+func (r *contextReadCloser) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.ReadCloser.Read(p)
+}
@@ -1,8 +1,13 @@
 package storage
 
 import (
+	"context"
+	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
+	pathpkg "path"
+	"strings"
 	"sync"
 )
 
@@ -26,15 +31,19 @@ func (d *DryrunDriver) Read(path string, offset int64, data []byte) (int, error)
 }
 
 func (d *DryrunDriver) ReadStream(path string, offset int64, length int64) (io.ReadCloser, error) {
-	panic("unsupport")
+	v, ok := d.dataMap.Load(path)
+	if !ok {
+		return nil, fmt.Errorf("no data available")
+	}
+	src := v.([]byte)
+	src = src[min(offset, int64(len(src))):]
+	src = src[:min(length, int64(len(src)))]
+	return io.NopCloser(bytes.NewReader(src)), nil
 }
 
+// Create stores a copy of the data, replacing an existing file
 func (d *DryrunDriver) Create(path string, data []byte) error {
-	_, ok := d.dataMap.Load(path)
-	if ok {
-		return fmt.Errorf("%s already exists", path)
-	}
-	d.dataMap.Store(path, data)
+	d.dataMap.Store(path, bytes.Clone(data))
 	return nil
 }
 
@@ -53,4 +62,101 @@ func (d *DryrunDriver) Find(path string) error {
 		return nil
 	}
 	return fmt.Errorf("%s not exists", path)
-}
\ No newline at end of file
+}
+func (d *DryrunDriver) ReadContext(ctx context.Context, path string, offset int64, data []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return d.Read(path, offset, data)
+}
+
+func (d *DryrunDriver) ReadStreamContext(ctx context.Context, path string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return d.ReadStream(path, offset, length)
+}
+
+func (d *DryrunDriver) CreateContext(ctx context.Context, path string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Create(path, data)
+}
+
+func (d *DryrunDriver) FindContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Find(path)
+}
+
+func (d *DryrunDriver) DeleteContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Delete(path)
+}
+
+func (d *DryrunDriver) MkdirContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Mkdir(path)
+}
+
+// Stat describes a stored file, directories are implied by the files
+func (d *DryrunDriver) Stat(path string) (FileInfo, error) {
+	if v, ok := d.dataMap.Load(path); ok {
+		return FileInfo{Name: pathpkg.Base(path), Size: int64(len(v.([]byte)))}, nil
+	}
+	if infos, _ := d.List(path); len(infos) > 0 {
+		return FileInfo{Name: pathpkg.Base(path), IsDir: true}, nil
+	}
+	return FileInfo{}, fmt.Errorf("%w: %s", fs.ErrNotExist, path)
+}
+
+// List returns the files and implied directories directly under dir
+func (d *DryrunDriver) List(dir string) ([]FileInfo, error) {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	var infos []FileInfo
+	dirs := make(map[string]bool)
+	d.dataMap.Range(func(k, v any) bool {
+		rest, ok := strings.CutPrefix(strings.TrimPrefix(k.(string), "/"), prefix)
+		if !ok {
+			return true
+		}
+		if name, _, isDir := strings.Cut(rest, "/"); isDir {
+			if !dirs[name] {
+				dirs[name] = true
+				infos = append(infos, FileInfo{Name: name, IsDir: true})
+			}
+		} else {
+			infos = append(infos, FileInfo{Name: name, Size: int64(len(v.([]byte)))})
+		}
+		return true
+	})
+	return infos, nil
+}
+
+// Rename renames a stored file, replacing the destination
+func (d *DryrunDriver) Rename(src, dst string) error {
+	v, ok := d.dataMap.LoadAndDelete(src)
+	if !ok {
+		return fmt.Errorf("%w: %s", fs.ErrNotExist, src)
+	}
+	d.dataMap.Store(dst, v)
+	return nil
+}
+
+// Usage reports the bytes held in memory, free space is unbounded
+func (d *DryrunDriver) Usage() (used, free int64, err error) {
+	d.dataMap.Range(func(k, v any) bool {
+		used += int64(len(v.([]byte)))
+		return true
+	})
+	return used, -1, nil
+}
@@ -0,0 +1,355 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jlaffaye/ftp"
+)
+
+// max idle connections kept by an ftp driver
+const ftpMaxIdle = 4
+
+// FTPDriver stores shards on an FTP server, optionally secured by explicit
+// TLS. Data connections are always passive.
+//
+// An FTP connection carries one transfer at a time, so the driver keeps a
+// pool of connections, and drops the ones found broken.
+type FTPDriver struct {
+	addr     string
+	basePath string
+	username string
+	password string
+	options  []ftp.DialOption
+
+	mu   sync.Mutex
+	idle []*ftp.ServerConn
+}
+
+func (d *FTPDriver) Init(s *StorageConfig) error {
+	if s.Endpoint == "" {
+		return errors.New("ftp needs an endpoint")
+	}
+	d.addr = s.Endpoint
+	if _, _, err := net.SplitHostPort(d.addr); err != nil {
+		d.addr = net.JoinHostPort(d.addr, "21")
+	}
+	d.basePath = "/" + strings.Trim(s.Path, "/")
+	d.username = s.Username
+	d.password = s.Password
+	if d.username == "" {
+		d.username = "anonymous"
+		d.password = "anonymous"
+	}
+
+	d.options = []ftp.DialOption{
+		ftp.DialWithTimeout(30 * time.Second),
+		ftp.DialWithDisabledEPSV(s.DisableEPSV),
+	}
+	if s.TLS {
+		host, _, _ := net.SplitHostPort(d.addr)
+		d.options = append(d.options, ftp.DialWithExplicitTLS(&tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: s.TLSInsecure,
+		}))
+	}
+
+	conn, err := d.get()
+	if err != nil {
+		return err
+	}
+	d.put(conn, nil)
+	return nil
+}
+
+// get takes an idle connection, or dials a new one
+func (d *FTPDriver) get() (*ftp.ServerConn, error) {
+	d.mu.Lock()
+	if n := len(d.idle); n > 0 {
+		conn := d.idle[n-1]
+		d.idle = d.idle[:n-1]
+		d.mu.Unlock()
+		return conn, nil
+	}
+	d.mu.Unlock()
+
+	conn, err := ftp.Dial(d.addr, d.options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", d.addr, err)
+	}
+	if err := conn.Login(d.username, d.password); err != nil {
+		conn.Quit()
+		return nil, fmt.Errorf("failed to login to %s: %v", d.addr, err)
+	}
+	return conn, nil
+}
+
+// put gives back a connection after an operation, which is closed if the
+// operation broke it
+func (d *FTPDriver) put(conn *ftp.ServerConn, err error) {
+	if err != nil && !isFTPReply(err) {
+		conn.Quit()
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.idle) >= ftpMaxIdle {
+		conn.Quit()
+		return
+	}
+	d.idle = append(d.idle, conn)
+}
+
+// isFTPReply tells an error replied by the server, after which the
+// connection is still usable
+func isFTPReply(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply)
+}
+
+// do runs f with a connection. When f fails because the connection is
+// broken, which happens to idle connections closed by the server, f is
+// retried once on a new connection.
+func (d *FTPDriver) do(f func(conn *ftp.ServerConn) error) error {
+	for retry := 0; ; retry++ {
+		conn, err := d.get()
+		if err != nil {
+			return err
+		}
+		err = f(conn)
+		d.put(conn, err)
+		if err == nil || isFTPReply(err) || retry > 0 {
+			return ftpError(err)
+		}
+	}
+}
+
+// ftpError turns the reply of a missing file into fs.ErrNotExist
+func ftpError(err error) error {
+	var reply *textproto.Error
+	if errors.As(err, &reply) && reply.Code == ftp.StatusFileUnavailable {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return err
+}
+
+func (d *FTPDriver) fullPath(p string) string {
+	return path.Join(d.basePath, strings.ReplaceAll(p, "\\", "/"))
+}
+
+// Read reads data from a file at a specific offset
+func (d *FTPDriver) Read(p string, offset int64, data []byte) (int, error) {
+	rc, err := d.ReadStream(p, offset, int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	n, err := io.ReadFull(rc, data)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// the file is shorter
+		return n, nil
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to read file from ftp: %v", err)
+	}
+	return n, nil
+}
+
+// ftpStream gives back the connection of a transfer once it is closed
+type ftpStream struct {
+	io.Reader
+	resp *ftp.Response
+	conn *ftp.ServerConn
+	d    *FTPDriver
+	once sync.Once
+}
+
+func (s *ftpStream) Close() error {
+	s.once.Do(func() {
+		if err := s.resp.Close(); err != nil {
+			// an aborted transfer may leave replies behind
+			s.conn.Quit()
+			return
+		}
+		s.d.put(s.conn, nil)
+	})
+	return nil
+}
+
+// ReadStream retrieves a file from the offset with REST, the connection is
+// held by the stream until it is closed
+func (d *FTPDriver) ReadStream(p string, offset int64, length int64) (io.ReadCloser, error) {
+	for retry := 0; ; retry++ {
+		conn, err := d.get()
+		if err != nil {
+			return nil, err
+		}
+		resp, err := conn.RetrFrom(d.fullPath(p), uint64(offset))
+		if err == nil {
+			return &ftpStream{Reader: io.LimitReader(resp, length), resp: resp, conn: conn, d: d}, nil
+		}
+		d.put(conn, err)
+		if isFTPReply(err) || retry > 0 {
+			return nil, fmt.Errorf("failed to read file from ftp: %w", ftpError(err))
+		}
+	}
+}
+
+// Create stores the file under a temporary name and renames it into place,
+// replacing an existing one
+func (d *FTPDriver) Create(p string, data []byte) error {
+	err := d.do(func(conn *ftp.ServerConn) error {
+		return renameInto(d.fullPath(p),
+			func(tmp string) error { return conn.Stor(tmp, bytes.NewReader(data)) },
+			func(tmp, full string) error { return ftpRename(conn, tmp, full) },
+			conn.Delete)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create file on ftp: %w", err)
+	}
+	return nil
+}
+
+// Find checks if a file or directory exists, by SIZE for files, and MLST
+// or CWD for directories
+func (d *FTPDriver) Find(p string) error {
+	return d.do(func(conn *ftp.ServerConn) error {
+		full := d.fullPath(p)
+		if _, err := conn.FileSize(full); err == nil {
+			return nil
+		}
+		if _, err := conn.GetEntry(full); err == nil {
+			return nil
+		}
+		return conn.ChangeDir(full)
+	})
+}
+
+// Delete deletes a file or an empty directory
+func (d *FTPDriver) Delete(p string) error {
+	err := d.do(func(conn *ftp.ServerConn) error {
+		full := d.fullPath(p)
+		err := conn.Delete(full)
+		if err != nil && isFTPReply(err) {
+			if conn.RemoveDir(full) == nil {
+				return nil
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete file from ftp: %w", err)
+	}
+	return nil
+}
+
+// Mkdir creates the directory and its parents
+func (d *FTPDriver) Mkdir(p string) error {
+	err := d.do(func(conn *ftp.ServerConn) error {
+		full := d.fullPath(p)
+		dir := ""
+		for _, name := range strings.Split(strings.Trim(full, "/"), "/") {
+			dir += "/" + name
+			// fails when the directory exists
+			conn.MakeDir(dir)
+		}
+		return conn.ChangeDir(full)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mkdir: %w", err)
+	}
+	return nil
+}
+
+// Stat describes a file by MLST, or by SIZE and MDTM on servers lacking it,
+// a directory is found by CWD then
+func (d *FTPDriver) Stat(p string) (FileInfo, error) {
+	var info FileInfo
+	err := d.do(func(conn *ftp.ServerConn) error {
+		full := d.fullPath(p)
+		info = FileInfo{Name: path.Base(full)}
+		if entry, err := conn.GetEntry(full); err == nil {
+			info.Size = int64(entry.Size)
+			info.ModTime = entry.Time
+			info.IsDir = entry.Type == ftp.EntryTypeFolder
+			return nil
+		}
+		size, err := conn.FileSize(full)
+		if err != nil {
+			info.IsDir = true
+			return conn.ChangeDir(full)
+		}
+		info.Size = size
+		if conn.IsGetTimeSupported() {
+			info.ModTime, _ = conn.GetTime(full)
+		}
+		return nil
+	})
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat on ftp: %w", err)
+	}
+	return info, nil
+}
+
+// List returns the files and directories directly under dir, by MLSD or
+// LIST
+func (d *FTPDriver) List(dir string) ([]FileInfo, error) {
+	var infos []FileInfo
+	err := d.do(func(conn *ftp.ServerConn) error {
+		entries, err := conn.List(d.fullPath(dir))
+		if err != nil {
+			return err
+		}
+		infos = infos[:0]
+		for _, entry := range entries {
+			if entry.Name == "." || entry.Name == ".." {
+				continue
+			}
+			infos = append(infos, FileInfo{
+				Name:    entry.Name,
+				Size:    int64(entry.Size),
+				ModTime: entry.Time,
+				IsDir:   entry.Type == ftp.EntryTypeFolder,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list on ftp: %w", err)
+	}
+	return infos, nil
+}
+
+// Rename renames a file by RNFR and RNTO, replacing the destination
+func (d *FTPDriver) Rename(src, dst string) error {
+	err := d.do(func(conn *ftp.ServerConn) error {
+		return ftpRename(conn, d.fullPath(src), d.fullPath(dst))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rename on ftp: %w", err)
+	}
+	return nil
+}
+
+// ftpRename replaces the destination, which is deleted first on servers
+// refusing to replace it
+func ftpRename(conn *ftp.ServerConn, src, dst string) error {
+	err := conn.Rename(src, dst)
+	if err == nil || !isFTPReply(err) {
+		return err
+	}
+	conn.Delete(dst)
+	return conn.Rename(src, dst)
+}
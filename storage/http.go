@@ -0,0 +1,275 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"strings"
+)
+
+// HTTPDriver stores shards on a shard server, see ShardServer
+type HTTPDriver struct {
+	endpoint *url.URL
+	token    string
+	// directory of shards on the server
+	prefix string
+	client *http.Client
+}
+
+func (d *HTTPDriver) Init(s *StorageConfig) error {
+	if s.Endpoint == "" {
+		return errors.New("http needs an endpoint")
+	}
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return fmt.Errorf("bad http endpoint: %s", s.Endpoint)
+	}
+
+	d.endpoint = endpoint
+	d.token = s.Token
+	d.prefix = strings.Trim(s.Path, "/")
+
+	// shards are transferred in parallel, keep enough connections alive
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 32
+	d.client = &http.Client{Transport: transport}
+
+	// check the server is reachable and the token is accepted
+	if err := d.MkdirContext(context.Background(), ""); err != nil {
+		return fmt.Errorf("failed to access shard server %s: %v", s.Endpoint, err)
+	}
+	return nil
+}
+
+func (d *HTTPDriver) Read(path string, offset int64, data []byte) (int, error) {
+	return d.ReadContext(context.Background(), path, offset, data)
+}
+
+func (d *HTTPDriver) ReadContext(ctx context.Context, path string, offset int64, data []byte) (int, error) {
+	rc, err := d.ReadStreamContext(ctx, path, offset, int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	n, err := io.ReadFull(rc, data)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		// the file is shorter
+		return n, nil
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to read file from http: %v", err)
+	}
+	return n, nil
+}
+
+func (d *HTTPDriver) ReadStream(path string, offset int64, length int64) (io.ReadCloser, error) {
+	return d.ReadStreamContext(context.Background(), path, offset, length)
+}
+
+func (d *HTTPDriver) ReadStreamContext(ctx context.Context, path string, offset int64, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := d.do(ctx, http.MethodGet, path, header, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file from http: %w", err)
+	}
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// the offset is beyond the end of the file
+		resp.Body.Close()
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("failed to read file from http: range not honored, %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// Create puts the file, overwriting an existing one
+func (d *HTTPDriver) Create(path string, data []byte) error {
+	return d.CreateContext(context.Background(), path, data)
+}
+
+func (d *HTTPDriver) CreateContext(ctx context.Context, path string, data []byte) error {
+	resp, err := d.do(ctx, http.MethodPut, path, nil, data)
+	if err != nil {
+		return fmt.Errorf("failed to create file on http: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Find checks if a file or directory exists
+func (d *HTTPDriver) Find(path string) error {
+	return d.FindContext(context.Background(), path)
+}
+
+func (d *HTTPDriver) FindContext(ctx context.Context, path string) error {
+	resp, err := d.do(ctx, http.MethodHead, path, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Delete deletes a file or an empty directory
+func (d *HTTPDriver) Delete(path string) error {
+	return d.DeleteContext(context.Background(), path)
+}
+
+func (d *HTTPDriver) DeleteContext(ctx context.Context, path string) error {
+	resp, err := d.do(ctx, http.MethodDelete, path, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete file from http: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (d *HTTPDriver) Mkdir(path string) error {
+	return d.MkdirContext(context.Background(), path)
+}
+
+func (d *HTTPDriver) MkdirContext(ctx context.Context, path string) error {
+	resp, err := d.do(ctx, "MKCOL", path, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to mkdir: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// urlPath returns the path of the url of a file
+func (d *HTTPDriver) urlPath(path string) string {
+	p := strings.Trim(strings.ReplaceAll(path, "\\", "/"), "/")
+	if d.prefix != "" {
+		p = d.prefix + "/" + p
+	}
+	return strings.TrimSuffix(d.endpoint.Path, "/") + "/" + p
+}
+
+// do sends a request on the path. A response of a status other than 2xx
+// or 416 is turned into an error, which wraps fs.ErrNotExist for 404.
+func (d *HTTPDriver) do(ctx context.Context, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	u := *d.endpoint
+	u.Path = d.urlPath(path)
+	u.RawPath = ""
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", fs.ErrNotExist, path)
+	}
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return nil, fmt.Errorf("http %s %s: %s %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// Stat describes a file or a directory
+func (d *HTTPDriver) Stat(path string) (FileInfo, error) {
+	resp, err := d.do(context.Background(), http.MethodHead, path, nil, nil)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat on http: %w", err)
+	}
+	resp.Body.Close()
+
+	info := FileInfo{
+		Name:  pathpkg.Base("/" + path),
+		IsDir: resp.Header.Get(shardServerDirHeader) != "",
+	}
+	if !info.IsDir {
+		info.Size = resp.ContentLength
+		info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+	}
+	return info, nil
+}
+
+// List returns the files and directories directly under dir
+func (d *HTTPDriver) List(dir string) ([]FileInfo, error) {
+	resp, err := d.do(context.Background(), http.MethodGet, dir, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list on http: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get(shardServerDirHeader) == "" {
+		return nil, fmt.Errorf("failed to list on http: %s is not a directory", dir)
+	}
+
+	var infos []FileInfo
+	if err := json.NewDecoder(resp.Body).Decode(&infos); err != nil {
+		return nil, fmt.Errorf("bad list result from http: %v", err)
+	}
+	return infos, nil
+}
+
+// Rename renames a file, replacing the destination
+func (d *HTTPDriver) Rename(src, dst string) error {
+	header := http.Header{}
+	header.Set("Destination", d.urlPath(dst))
+	resp, err := d.do(context.Background(), "MOVE", src, header, nil)
+	if err != nil {
+		return fmt.Errorf("failed to rename on http: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Usage reports the usage of the file system of the shard server
+func (d *HTTPDriver) Usage() (used, free int64, err error) {
+	u := *d.endpoint
+	u.RawQuery = "usage"
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return -1, -1, err
+	}
+	if d.token != "" {
+		req.Header.Set("Authorization", "Bearer "+d.token)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return -1, -1, fmt.Errorf("failed to get usage from http: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return -1, -1, fmt.Errorf("failed to get usage from http: %s", resp.Status)
+	}
+
+	var usage shardServerUsage
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return -1, -1, fmt.Errorf("bad usage from http: %v", err)
+	}
+	return usage.Used, usage.Free, nil
+}
@@ -6,6 +6,28 @@ type StorageConfig struct {
 	Path     string `json:"path,omitempty"`
 	Username string `json:"username,omitempty"`
 	Password string `json:"password,omitempty"`
+
+	// s3
+	Endpoint  string `json:"endpoint,omitempty"`
+	Bucket    string `json:"bucket,omitempty"`
+	Region    string `json:"region,omitempty"`
+	AccessKey string `json:"accessKey,omitempty"`
+	SecretKey string `json:"secretKey,omitempty"`
+
+	// sftp, the endpoint is the host[:port]
+	KeyPath    string `json:"keyPath,omitempty"`
+	KnownHosts string `json:"knownHosts,omitempty"`
+
+	// ftp, the endpoint is the host[:port]
+	TLS         bool `json:"tls,omitempty"`
+	TLSInsecure bool `json:"tlsInsecure,omitempty"`
+	DisableEPSV bool `json:"disableEPSV,omitempty"`
+
+	// http, the endpoint is the url of the shard server
+	Token string `json:"token,omitempty"`
+
+	// tiered, from the fastest to the slowest
+	Tiers []TierConfig `json:"tiers,omitempty"`
 }
 
 type StorageDriver interface {
@@ -14,7 +36,8 @@ type StorageDriver interface {
 	// read data from file
 	Read(path string, offset int64, data []byte) (int, error)
 	ReadStream(path string, offset int64, length int64) (io.ReadCloser, error)
-	// create file, error when exist
+	// create file atomically, replacing an existing one. A reader never
+	// sees a partial file.
 	Create(path string, data []byte) error
 	// file or dir exist
 	Find(path string) error
@@ -25,10 +48,17 @@ type StorageDriver interface {
 }
 
 
+// Drivers may also implement ContextDriver, see WithContext
+
 var DriverInitializers = map[string]func() StorageDriver{
 	"local": func() StorageDriver { return &LocalDriver{} },
 	"webdav": func() StorageDriver { return &WebDAVDriver{} },
 	"dryrun": func() StorageDriver { return &DryrunDriver{} },
+	"s3": func() StorageDriver { return &S3Driver{} },
+	"sftp": func() StorageDriver { return &SFTPDriver{} },
+	"ftp": func() StorageDriver { return &FTPDriver{} },
+	"http": func() StorageDriver { return &HTTPDriver{} },
+	"tiered": func() StorageDriver { return &TieredDriver{} },
 }
 
 
@@ -1,12 +1,11 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-
-	log "github.com/sirupsen/logrus"
 	// log "github.com/sirupsen/logrus"
 )
 
@@ -34,7 +33,7 @@ func (d *LocalDriver) Read(path string, offset int64, data []byte) (int, error)
 	fullPath := filepath.Join(d.basePath, path)
 	file, err := os.Open(fullPath)
 	if err != nil {
-		return 0, fmt.Errorf("failed to open file: %v", err)
+		return 0, fmt.Errorf("failed to open file: %w", err)
 	}
 	defer file.Close()
 
@@ -50,7 +49,7 @@ func (d *LocalDriver) ReadStream(path string, offset int64, length int64) (io.Re
 	fullPath := filepath.Join(d.basePath, path)
 	file, err := os.Open(fullPath)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
+		return nil, fmt.Errorf("failed to open file: %w", err)
 	}
 
 	file.Seek(int64(offset), 0)
@@ -58,14 +57,10 @@ func (d *LocalDriver) ReadStream(path string, offset int64, length int64) (io.Re
 	return LimitReadCloser(file, length), nil
 }
 
-// Create creates a new file, returns error if file already exists
+// Create creates a file atomically, replacing an existing one
 func (d *LocalDriver) Create(path string, data []byte) error {
 	fullPath := filepath.Join(d.basePath, path)
-	if _, err := os.Stat(fullPath); err == nil {
-		// return fmt.Errorf("file %s already exists", path)
-		log.Warnf("file %s has existed, will be overwritten", path)
-	}
-	err := os.WriteFile(fullPath, data, 0644)
+	err := writeFileAtomic(fullPath, data)
 	if err != nil {
 		return fmt.Errorf("failed to create file: %v", err)
 	}
@@ -76,7 +71,7 @@ func (d *LocalDriver) Create(path string, data []byte) error {
 func (d *LocalDriver) Find(path string) error {
 	fullPath := filepath.Join(d.basePath, path)
 	if _, err := os.Stat(fullPath); os.IsNotExist(err) {
-		return fmt.Errorf("file or directory does not exist: %s", path)
+		return fmt.Errorf("file or directory does not exist: %w", err)
 	}
 	return nil
 }
@@ -86,7 +81,7 @@ func (d *LocalDriver) Delete(path string) error {
 	fullPath := filepath.Join(d.basePath, path)
 	err := os.Remove(fullPath)
 	if err != nil {
-		return fmt.Errorf("failed to delete file: %v", err)
+		return fmt.Errorf("failed to delete file: %w", err)
 	}
 	return nil
 }
@@ -123,4 +118,100 @@ func LimitReadCloser(rc io.ReadCloser, limit int64) io.ReadCloser {
             N: limit,
         },
     }
-}
\ No newline at end of file
+}
+// local operations are short, so the context is only checked before them
+
+func (d *LocalDriver) ReadContext(ctx context.Context, path string, offset int64, data []byte) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return d.Read(path, offset, data)
+}
+
+func (d *LocalDriver) ReadStreamContext(ctx context.Context, path string, offset int64, length int64) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rc, err := d.ReadStream(path, offset, length)
+	if err != nil {
+		return nil, err
+	}
+	return ContextReadCloser(ctx, rc), nil
+}
+
+func (d *LocalDriver) CreateContext(ctx context.Context, path string, data []byte) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Create(path, data)
+}
+
+func (d *LocalDriver) FindContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Find(path)
+}
+
+func (d *LocalDriver) DeleteContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Delete(path)
+}
+
+func (d *LocalDriver) MkdirContext(ctx context.Context, path string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return d.Mkdir(path)
+}
+
+// Stat describes a file or a directory
+func (d *LocalDriver) Stat(path string) (FileInfo, error) {
+	info, err := os.Stat(filepath.Join(d.basePath, path))
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat: %w", err)
+	}
+	return localFileInfo(info), nil
+}
+
+// List returns the files and directories directly under dir
+func (d *LocalDriver) List(dir string) ([]FileInfo, error) {
+	return localList(filepath.Join(d.basePath, dir))
+}
+
+func localList(fullPath string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list: %w", err)
+	}
+	infos := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			// removed meanwhile
+			continue
+		}
+		infos = append(infos, localFileInfo(info))
+	}
+	return infos, nil
+}
+
+func localFileInfo(info os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+}
+
+// Rename renames a file, replacing the destination
+func (d *LocalDriver) Rename(src, dst string) error {
+	err := os.Rename(filepath.Join(d.basePath, src), filepath.Join(d.basePath, dst))
+	if err != nil {
+		return fmt.Errorf("failed to rename: %w", err)
+	}
+	return nil
+}
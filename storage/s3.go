@@ -0,0 +1,419 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	pathpkg "path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3Driver stores shards as objects of a bucket of an S3-compatible
+// service, such as MinIO, Backblaze B2 or Cloudflare R2. Requests use
+// path-style addressing and are signed with AWS signature version 4.
+//
+// Directories don't exist in S3, so Mkdir does nothing and a directory is
+// found when an object has it as prefix.
+type S3Driver struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	// key prefix of all objects in the bucket
+	prefix string
+	client *http.Client
+}
+
+func (d *S3Driver) Init(s *StorageConfig) error {
+	if s.Endpoint == "" || s.Bucket == "" {
+		return errors.New("s3 needs an endpoint and a bucket")
+	}
+	endpoint, err := url.Parse(s.Endpoint)
+	if err != nil || endpoint.Host == "" {
+		return fmt.Errorf("bad s3 endpoint: %s", s.Endpoint)
+	}
+
+	d.endpoint = endpoint
+	d.bucket = s.Bucket
+	d.region = s.Region
+	if d.region == "" {
+		d.region = "us-east-1"
+	}
+	d.accessKey = s.AccessKey
+	d.secretKey = s.SecretKey
+	d.prefix = strings.Trim(s.Path, "/")
+	d.client = &http.Client{}
+
+	// check the bucket is accessible
+	resp, err := d.do(context.Background(), http.MethodHead, "", nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to access bucket %s: %v", s.Bucket, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// key returns the object key of a path
+func (d *S3Driver) key(path string) string {
+	path = strings.Trim(strings.ReplaceAll(path, "\\", "/"), "/")
+	if d.prefix == "" {
+		return path
+	}
+	if path == "" {
+		return d.prefix
+	}
+	return d.prefix + "/" + path
+}
+
+func (d *S3Driver) Read(path string, offset int64, data []byte) (int, error) {
+	return d.ReadContext(context.Background(), path, offset, data)
+}
+
+func (d *S3Driver) ReadContext(ctx context.Context, path string, offset int64, data []byte) (int, error) {
+	rc, err := d.ReadStreamContext(ctx, path, offset, int64(len(data)))
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	n, err := io.ReadFull(rc, data)
+	if err == io.ErrUnexpectedEOF {
+		// the object is shorter
+		return n, nil
+	}
+	if err != nil {
+		return n, fmt.Errorf("failed to read file from s3: %v", err)
+	}
+	return n, nil
+}
+
+func (d *S3Driver) ReadStream(path string, offset int64, length int64) (io.ReadCloser, error) {
+	return d.ReadStreamContext(context.Background(), path, offset, length)
+}
+
+func (d *S3Driver) ReadStreamContext(ctx context.Context, path string, offset int64, length int64) (io.ReadCloser, error) {
+	if length <= 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	header := http.Header{}
+	header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	resp, err := d.do(ctx, http.MethodGet, d.key(path), nil, header, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file from s3: %w", err)
+	}
+	return resp.Body, nil
+}
+
+// Create puts the object, overwriting an existing one
+func (d *S3Driver) Create(path string, data []byte) error {
+	return d.CreateContext(context.Background(), path, data)
+}
+
+func (d *S3Driver) CreateContext(ctx context.Context, path string, data []byte) error {
+	resp, err := d.do(ctx, http.MethodPut, d.key(path), nil, nil, data)
+	if err != nil {
+		return fmt.Errorf("failed to create file on s3: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (d *S3Driver) Find(path string) error {
+	return d.FindContext(context.Background(), path)
+}
+
+// FindContext finds an object, or a directory holding objects
+func (d *S3Driver) FindContext(ctx context.Context, path string) error {
+	resp, err := d.do(ctx, http.MethodHead, d.key(path), nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		return nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	query := url.Values{}
+	query.Set("list-type", "2")
+	query.Set("max-keys", "1")
+	query.Set("prefix", d.key(path)+"/")
+	resp, err = d.do(ctx, http.MethodGet, "", query, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		KeyCount int `xml:"KeyCount"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("bad list result from s3: %v", err)
+	}
+	if result.KeyCount == 0 {
+		return fmt.Errorf("%w: %s", fs.ErrNotExist, path)
+	}
+	return nil
+}
+
+// Delete deletes an object, deleting a directory does nothing as it
+// disappears with its last object
+func (d *S3Driver) Delete(path string) error {
+	return d.DeleteContext(context.Background(), path)
+}
+
+func (d *S3Driver) DeleteContext(ctx context.Context, path string) error {
+	resp, err := d.do(ctx, http.MethodDelete, d.key(path), nil, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to delete file from s3: %w", err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (d *S3Driver) Mkdir(path string) error {
+	return nil
+}
+
+func (d *S3Driver) MkdirContext(ctx context.Context, path string) error {
+	return ctx.Err()
+}
+
+// do sends a signed request on the bucket, or on an object of it when key
+// is not empty. A response of a status other than 2xx is turned into an
+// error, which wraps fs.ErrNotExist for 404.
+func (d *S3Driver) do(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u := *d.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + d.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) == 0 {
+		req.Body = http.NoBody
+	}
+	req.ContentLength = int64(len(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	d.sign(req, body, time.Now())
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 == 2 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", fs.ErrNotExist, key)
+	}
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&s3Err)
+	return nil, fmt.Errorf("s3 %s %s: %s %s %s", method, key, resp.Status, s3Err.Code, s3Err.Message)
+}
+
+// sign adds the headers of AWS signature version 4 to the request
+func (d *S3Driver) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	// sign the host, the range and the x-amz-* headers
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "range" || strings.HasPrefix(k, "x-amz-") {
+			headers[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + d.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+d.secretKey), date)
+	key = hmacSHA256(key, d.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		d.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by key as signature version 4
+// requires
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode escapes every byte except the unreserved characters of
+// RFC 3986, and '/' unless encodeSlash is set
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Stat describes an object, or a directory holding objects
+func (d *S3Driver) Stat(path string) (FileInfo, error) {
+	ctx := context.Background()
+	info := FileInfo{Name: pathpkg.Base("/" + path)}
+	resp, err := d.do(ctx, http.MethodHead, d.key(path), nil, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+		info.Size = resp.ContentLength
+		info.ModTime, _ = http.ParseTime(resp.Header.Get("Last-Modified"))
+		return info, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return FileInfo{}, fmt.Errorf("failed to stat on s3: %w", err)
+	}
+	if err := d.FindContext(ctx, path); err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat on s3: %w", err)
+	}
+	info.IsDir = true
+	return info, nil
+}
+
+// List returns the objects and the common prefixes directly under dir
+func (d *S3Driver) List(dir string) ([]FileInfo, error) {
+	prefix := d.key(dir)
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	var infos []FileInfo
+	token := ""
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("delimiter", "/")
+		query.Set("prefix", prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := d.do(context.Background(), http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list on s3: %w", err)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string    `xml:"Key"`
+				Size         int64     `xml:"Size"`
+				LastModified time.Time `xml:"LastModified"`
+			} `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad list result from s3: %v", err)
+		}
+
+		for _, c := range result.Contents {
+			infos = append(infos, FileInfo{
+				Name:    strings.TrimPrefix(c.Key, prefix),
+				Size:    c.Size,
+				ModTime: c.LastModified,
+			})
+		}
+		for _, p := range result.CommonPrefixes {
+			infos = append(infos, FileInfo{
+				Name:  strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"),
+				IsDir: true,
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("failed to list on s3: %w: %s", fs.ErrNotExist, dir)
+	}
+	return infos, nil
+}
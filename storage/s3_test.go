@@ -0,0 +1,426 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testBucket    = "bucket"
+	testRegion    = "eu-test-1"
+	testAccessKey = "AKTEST"
+	testSecretKey = "secret"
+	// keys of a list page, small to exercise the pagination
+	fakeS3PageSize = 2
+)
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+// fakeS3 serves a single bucket with path-style addressing, checking the
+// signature version 4 of every request
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string]fakeObject
+	// ranges requested by GETs
+	ranges []string
+	lists  int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *httptest.Server) {
+	f := &fakeS3{objects: make(map[string]fakeObject)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server
+}
+
+// stats returns the stored objects by key, the ranges requested and the
+// number of list requests so far
+func (f *fakeS3) stats() (map[string]fakeObject, []string, int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	objects := make(map[string]fakeObject, len(f.objects))
+	for k, v := range f.objects {
+		objects[k] = v
+	}
+	return objects, append([]string(nil), f.ranges...), f.lists
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if code, msg := f.verify(r, body); code != "" {
+		writeS3Error(w, http.StatusForbidden, code, msg)
+		return
+	}
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(path, "/")
+	if bucket != testBucket {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", bucket)
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+		case r.Method == http.MethodGet && r.URL.Query().Get("list-type") == "2":
+			f.list(w, r.URL.Query())
+		default:
+			writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+		}
+		return
+	}
+
+	obj, ok := f.objects[key]
+	switch r.Method {
+	case http.MethodPut:
+		f.objects[key] = fakeObject{data: body, modTime: time.Now()}
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodHead, http.MethodGet:
+		if !ok {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", key)
+			return
+		}
+		w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+		data := obj.data
+		status := http.StatusOK
+		if rng := r.Header.Get("Range"); rng != "" && r.Method == http.MethodGet {
+			f.ranges = append(f.ranges, rng)
+			var start, end int
+			spec, _ := strings.CutPrefix(rng, "bytes=")
+			first, last, _ := strings.Cut(spec, "-")
+			start, _ = strconv.Atoi(first)
+			end, _ = strconv.Atoi(last)
+			if start >= len(data) {
+				writeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", rng)
+				return
+			}
+			data = data[start:min(end+1, len(data))]
+			status = http.StatusPartialContent
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.WriteHeader(status)
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method)
+	}
+}
+
+// list answers a ListObjectsV2 request, whose continuation token is the
+// index of the next entry
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	f.lists++
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+
+	var entries []string // keys, and common prefixes ending with the delimiter
+	seen := make(map[string]bool)
+	for key := range f.objects {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		entry := key
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				entry = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if !seen[entry] {
+			seen[entry] = true
+			entries = append(entries, entry)
+		}
+	}
+	sort.Strings(entries)
+
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+	size := fakeS3PageSize
+	if maxKeys, err := strconv.Atoi(query.Get("max-keys")); err == nil && maxKeys < size {
+		size = maxKeys
+	}
+	end := min(start+size, len(entries))
+
+	type content struct {
+		Key          string
+		Size         int
+		LastModified string
+	}
+	type commonPrefix struct {
+		Prefix string
+	}
+	result := struct {
+		XMLName               xml.Name `xml:"ListBucketResult"`
+		KeyCount              int
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+		Contents              []content
+		CommonPrefixes        []commonPrefix
+	}{KeyCount: end - start, IsTruncated: end < len(entries)}
+	if result.IsTruncated {
+		result.NextContinuationToken = strconv.Itoa(end)
+	}
+	for _, entry := range entries[start:end] {
+		if delimiter != "" && strings.HasSuffix(entry, delimiter) {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{entry})
+			continue
+		}
+		obj := f.objects[entry]
+		result.Contents = append(result.Contents, content{entry, len(obj.data), obj.modTime.UTC().Format(time.RFC3339)})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+// verify checks the signature of the request, returning the code of the
+// error when it is bad
+func (f *fakeS3) verify(r *http.Request, body []byte) (string, string) {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return "AccessDenied", "not signed with signature version 4"
+	}
+	fields := make(map[string]string)
+	for _, field := range strings.Split(auth, ", ") {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+	scope := strings.SplitN(fields["Credential"], "/", 2)
+	if len(scope) != 2 || scope[0] != testAccessKey {
+		return "InvalidAccessKeyId", fields["Credential"]
+	}
+
+	sum := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(sum[:])
+	if r.Header.Get("X-Amz-Content-Sha256") != payloadHash {
+		return "XAmzContentSHA256Mismatch", "payload hash mismatch"
+	}
+
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		params = append(params, queryEscape(k)+"="+queryEscape(query.Get(k)))
+	}
+
+	var headers strings.Builder
+	for _, name := range strings.Split(fields["SignedHeaders"], ";") {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+
+	canonicalRequest := strings.Join([]string{
+		r.Method,
+		r.URL.EscapedPath(),
+		strings.Join(params, "&"),
+		headers.String(),
+		fields["SignedHeaders"],
+		payloadHash,
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	amzDate := r.Header.Get("X-Amz-Date")
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope[1] + "\n" + hex.EncodeToString(requestHash[:])
+
+	date, region, _ := strings.Cut(scope[1], "/")
+	region, _, _ = strings.Cut(region, "/")
+	if region != testRegion {
+		return "AuthorizationHeaderMalformed", "region " + region
+	}
+	key := hmacSHA256([]byte("AWS4"+testSecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	if hex.EncodeToString(hmacSHA256(key, stringToSign)) != fields["Signature"] {
+		return "SignatureDoesNotMatch", canonicalRequest
+	}
+	return "", ""
+}
+
+func queryEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		Code    string
+		Message string
+	}{Code: code, Message: message})
+}
+
+func newTestS3Driver(t *testing.T, endpoint, secretKey string) (*S3Driver, error) {
+	d := &S3Driver{}
+	return d, d.Init(&StorageConfig{
+		Endpoint:  endpoint,
+		Bucket:    testBucket,
+		Region:    testRegion,
+		AccessKey: testAccessKey,
+		SecretKey: secretKey,
+		Path:      "rnas",
+	})
+}
+
+func TestS3DriverReadWrite(t *testing.T) {
+	fake, server := newFakeS3(t)
+	d, err := newTestS3Driver(t, server.URL, testSecretKey)
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	data := []byte("0123456789abcdefghij")
+	path := "cfg/1/a shard.jpg"
+	if err := d.Create(path, data); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if objects, _, _ := fake.stats(); objects["rnas/cfg/1/a shard.jpg"].data == nil {
+		t.Fatalf("object is not stored under the prefix, got %v", objects)
+	}
+
+	buf := make([]byte, len(data))
+	n, err := d.Read(path, 0, buf)
+	if err != nil || !bytes.Equal(buf[:n], data) {
+		t.Fatalf("read returned %q, %v", buf[:n], err)
+	}
+
+	rc, err := d.ReadStream(path, 5, 4)
+	if err != nil {
+		t.Fatalf("read stream: %v", err)
+	}
+	part, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil || string(part) != "5678" {
+		t.Fatalf("ranged read returned %q, %v", part, err)
+	}
+	if _, ranges, _ := fake.stats(); ranges[len(ranges)-1] != "bytes=5-8" {
+		t.Fatalf("ranged read requested %v", ranges)
+	}
+
+	// a read past the end is short
+	n, err = d.Read(path, 15, buf)
+	if err != nil || string(buf[:n]) != "fghij" {
+		t.Fatalf("short read returned %q, %v", buf[:n], err)
+	}
+
+	info, err := d.Stat(path)
+	if err != nil || info.IsDir || info.Size != int64(len(data)) || info.Name != "a shard.jpg" {
+		t.Fatalf("stat returned %+v, %v", info, err)
+	}
+
+	if err := d.Delete(path); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := d.Read(path, 0, buf); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("read of a deleted object returned %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestS3DriverFind(t *testing.T) {
+	fake, server := newFakeS3(t)
+	d, err := newTestS3Driver(t, server.URL, testSecretKey)
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	if err := d.Create("cfg/1/a.jpg", []byte("a")); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	if err := d.Find("cfg/1/a.jpg"); err != nil {
+		t.Fatalf("find object: %v", err)
+	}
+	_, _, lists := fake.stats()
+	// directories are found by listing their prefix
+	if err := d.Find("cfg/1"); err != nil {
+		t.Fatalf("find directory: %v", err)
+	}
+	if _, _, after := fake.stats(); after != lists+1 {
+		t.Fatal("directory is found without listing")
+	}
+	if info, err := d.Stat("cfg"); err != nil || !info.IsDir {
+		t.Fatalf("stat of directory returned %+v, %v", info, err)
+	}
+	for _, path := range []string{"cfg/1/b.jpg", "cfg/2", "cf"} {
+		if err := d.Find(path); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("find of missing %s returned %v, want %v", path, err, fs.ErrNotExist)
+		}
+	}
+}
+
+func TestS3DriverList(t *testing.T) {
+	fake, server := newFakeS3(t)
+	d, err := newTestS3Driver(t, server.URL, testSecretKey)
+	if err != nil {
+		t.Fatalf("init: %v", err)
+	}
+
+	want := map[string]bool{"sub": true}
+	for i := 0; i < 5; i++ {
+		name := "shard" + strconv.Itoa(i) + ".jpg"
+		want[name] = false
+		if err := d.Create("cfg/"+name, []byte(name)); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+	}
+	if err := d.Create("cfg/sub/x.jpg", []byte("x")); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+
+	_, _, lists := fake.stats()
+	infos, err := d.List("cfg")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if _, _, after := fake.stats(); after-lists != 3 {
+		t.Fatalf("list took %d pages, want 3", after-lists)
+	}
+	if len(infos) != len(want) {
+		t.Fatalf("list returned %d entries, want %d: %+v", len(infos), len(want), infos)
+	}
+	for _, info := range infos {
+		isDir, ok := want[info.Name]
+		if !ok || info.IsDir != isDir {
+			t.Fatalf("unexpected entry %+v", info)
+		}
+		if !isDir && info.Size != int64(len(info.Name)) {
+			t.Fatalf("entry %s has size %d", info.Name, info.Size)
+		}
+	}
+
+	if _, err := d.List("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("list of a missing directory returned %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestS3DriverBadSignature(t *testing.T) {
+	_, server := newFakeS3(t)
+	// a HEAD response has no body to tell the code of the error
+	if _, err := newTestS3Driver(t, server.URL, "wrong"); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("init with a wrong secret returned %v", err)
+	}
+}
@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTPDriver stores shards on a host reachable over SSH. A single
+// connection is shared by all operations, and reestablished once it is
+// found broken.
+type SFTPDriver struct {
+	addr     string
+	basePath string
+	config   *ssh.ClientConfig
+
+	mu     sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+}
+
+func (d *SFTPDriver) Init(s *StorageConfig) error {
+	if s.Endpoint == "" {
+		return errors.New("sftp needs an endpoint")
+	}
+	d.addr = s.Endpoint
+	if _, _, err := net.SplitHostPort(d.addr); err != nil {
+		d.addr = net.JoinHostPort(d.addr, "22")
+	}
+	d.basePath = s.Path
+	if d.basePath == "" {
+		d.basePath = "."
+	}
+
+	var auth []ssh.AuthMethod
+	if s.KeyPath != "" {
+		signer, err := loadPrivateKey(s.KeyPath, s.Password)
+		if err != nil {
+			return err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if s.Password != "" {
+		auth = append(auth, ssh.Password(s.Password))
+	}
+	if len(auth) == 0 {
+		return errors.New("sftp needs a password or a keyPath")
+	}
+
+	knownHostsPath := s.KnownHosts
+	if knownHostsPath == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("failed to find known hosts: %v", err)
+		}
+		knownHostsPath = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return fmt.Errorf("failed to load known hosts: %v", err)
+	}
+
+	d.config = &ssh.ClientConfig{
+		User:            s.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         30 * time.Second,
+	}
+
+	_, err = d.connect()
+	return err
+}
+
+// loadPrivateKey reads a private key, which is decrypted by the
+// passphrase if it is protected
+func loadPrivateKey(keyPath, passphrase string) (ssh.Signer, error) {
+	key, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) && passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %v", err)
+	}
+	return signer, nil
+}
+
+// connect returns the current sftp client, dialing one if there is none
+func (d *SFTPDriver) connect() (*sftp.Client, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	conn, err := ssh.Dial("tcp", d.addr, d.config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", d.addr, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to start sftp on %s: %v", d.addr, err)
+	}
+	d.conn = conn
+	d.client = client
+	return client, nil
+}
+
+// reset drops the client if it is still the current one
+func (d *SFTPDriver) reset(client *sftp.Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client != client {
+		return
+	}
+	d.client.Close()
+	d.conn.Close()
+	d.client = nil
+	d.conn = nil
+}
+
+// do runs f with the sftp client. When f fails because the connection is
+// broken, f is retried once on a new connection.
+func (d *SFTPDriver) do(f func(client *sftp.Client) error) error {
+	client, err := d.connect()
+	if err != nil {
+		return err
+	}
+	err = f(client)
+	if err == nil {
+		return nil
+	}
+
+	// check the connection only on failure
+	if _, werr := client.Getwd(); werr == nil {
+		return err
+	}
+	log.Warnf("sftp connection to %s is broken, reconnect: %v", d.addr, err)
+	d.reset(client)
+
+	client, err = d.connect()
+	if err != nil {
+		return err
+	}
+	return f(client)
+}
+
+func (d *SFTPDriver) fullPath(p string) string {
+	return path.Join(d.basePath, strings.ReplaceAll(p, "\\", "/"))
+}
+
+// Read reads data from a file at a specific offset
+func (d *SFTPDriver) Read(p string, offset int64, data []byte) (int, error) {
+	var n int
+	err := d.do(func(client *sftp.Client) error {
+		file, err := client.Open(d.fullPath(p))
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		n, err = io.ReadFull(file, data)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			// the file is shorter
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read file from sftp: %w", err)
+	}
+	return n, nil
+}
+
+func (d *SFTPDriver) ReadStream(p string, offset int64, length int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := d.do(func(client *sftp.Client) error {
+		file, err := client.Open(d.fullPath(p))
+		if err != nil {
+			return err
+		}
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			file.Close()
+			return err
+		}
+		rc = LimitReadCloser(file, length)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file from sftp: %w", err)
+	}
+	return rc, nil
+}
+
+// Create writes the file under a temporary name and renames it into place,
+// replacing an existing one
+func (d *SFTPDriver) Create(p string, data []byte) error {
+	err := d.do(func(client *sftp.Client) error {
+		return renameInto(d.fullPath(p),
+			func(tmp string) error {
+				file, err := client.Create(tmp)
+				if err != nil {
+					return err
+				}
+				if _, err := file.Write(data); err != nil {
+					file.Close()
+					return err
+				}
+				return file.Close()
+			},
+			func(tmp, full string) error { return sftpRename(client, tmp, full) },
+			client.Remove)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create file on sftp: %w", err)
+	}
+	return nil
+}
+
+// Find checks if a file or directory exists
+func (d *SFTPDriver) Find(p string) error {
+	return d.do(func(client *sftp.Client) error {
+		_, err := client.Stat(d.fullPath(p))
+		return err
+	})
+}
+
+// Delete deletes a file or an empty directory
+func (d *SFTPDriver) Delete(p string) error {
+	err := d.do(func(client *sftp.Client) error {
+		return client.Remove(d.fullPath(p))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete file from sftp: %w", err)
+	}
+	return nil
+}
+
+func (d *SFTPDriver) Mkdir(p string) error {
+	err := d.do(func(client *sftp.Client) error {
+		return client.MkdirAll(d.fullPath(p))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to mkdir: %w", err)
+	}
+	return nil
+}
+
+// Stat describes a file or a directory
+func (d *SFTPDriver) Stat(p string) (FileInfo, error) {
+	var info os.FileInfo
+	err := d.do(func(client *sftp.Client) error {
+		var err error
+		info, err = client.Stat(d.fullPath(p))
+		return err
+	})
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat on sftp: %w", err)
+	}
+	return sftpFileInfo(info), nil
+}
+
+// List returns the files and directories directly under dir
+func (d *SFTPDriver) List(dir string) ([]FileInfo, error) {
+	var infos []os.FileInfo
+	err := d.do(func(client *sftp.Client) error {
+		var err error
+		infos, err = client.ReadDir(d.fullPath(dir))
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list on sftp: %w", err)
+	}
+	result := make([]FileInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, sftpFileInfo(info))
+	}
+	return result, nil
+}
+
+func sftpFileInfo(info os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+}
+
+// Rename renames a file, replacing the destination with the posix-rename
+// extension when the server has it
+func (d *SFTPDriver) Rename(src, dst string) error {
+	err := d.do(func(client *sftp.Client) error {
+		return sftpRename(client, d.fullPath(src), d.fullPath(dst))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rename on sftp: %w", err)
+	}
+	return nil
+}
+
+func sftpRename(client *sftp.Client, src, dst string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(src, dst)
+	}
+	// plain sftp rename fails on an existing destination
+	client.Remove(dst)
+	return client.Rename(src, dst)
+}
+
+// Usage reports the usage of the remote file system, with the statvfs
+// extension of OpenSSH
+func (d *SFTPDriver) Usage() (used, free int64, err error) {
+	var st *sftp.StatVFS
+	err = d.do(func(client *sftp.Client) error {
+		if _, ok := client.HasExtension("statvfs@openssh.com"); !ok {
+			return fmt.Errorf("usage: %w", ErrUnsupported)
+		}
+		var err error
+		st, err = client.StatVFS(d.fullPath(""))
+		return err
+	})
+	if err != nil {
+		return -1, -1, err
+	}
+	used = int64((st.Blocks - st.Bfree) * st.Frsize)
+	free = int64(st.Bavail * st.Frsize)
+	return used, free, nil
+}
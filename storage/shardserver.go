@@ -0,0 +1,183 @@
+package storage
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// max size of a shard accepted by a shard server
+	shardServerMaxBody = 1 << 30
+	// header telling a directory in the responses of a shard server
+	shardServerDirHeader = "X-Rnas-Dir"
+)
+
+type shardServerUsage struct {
+	Used int64 `json:"used"`
+	Free int64 `json:"free"`
+}
+
+// ShardServer exposes a local directory over HTTP for HTTPDriver:
+//
+//	GET    read a file, honoring Range
+//	HEAD   check a file or directory exists
+//	PUT    create or overwrite a file
+//	DELETE delete a file or an empty directory
+//	MKCOL  create a directory and its parents
+//	MOVE   rename a file to the path of the Destination header
+//
+// GET on a directory lists it as JSON, and GET with the query "usage"
+// reports the usage of the file system.
+//
+// Requests must carry the token as "Authorization: Bearer <token>" unless
+// the token is empty.
+type ShardServer struct {
+	local LocalDriver
+	token string
+}
+
+// NewShardServer returns a shard server of the root directory, which is
+// created if it does not exist
+func NewShardServer(root, token string) (*ShardServer, error) {
+	s := &ShardServer{token: token}
+	if err := s.local.Init(&StorageConfig{Path: root}); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ShardServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="rnas"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	p, ok := cleanShardPath(r.URL.Path)
+	if !ok {
+		http.Error(w, "bad path", http.StatusBadRequest)
+		return
+	}
+	fullPath := filepath.Join(s.local.basePath, filepath.FromSlash(p))
+
+	var err error
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if r.URL.Query().Has("usage") {
+			err = s.serveUsage(w)
+			break
+		}
+		err = s.serveFile(w, r, fullPath)
+	case http.MethodPut:
+		err = s.putFile(w, r, fullPath)
+	case http.MethodDelete:
+		err = os.Remove(fullPath)
+	case "MKCOL":
+		err = os.MkdirAll(fullPath, 0744)
+	case "MOVE":
+		dst, ok := cleanShardPath(r.Header.Get("Destination"))
+		if !ok {
+			http.Error(w, "bad destination", http.StatusBadRequest)
+			return
+		}
+		err = s.local.Rename(p, dst)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT, DELETE, MKCOL, MOVE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	switch {
+	case err == nil:
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.WriteHeader(http.StatusNoContent)
+		}
+	case errors.Is(err, fs.ErrNotExist):
+		http.Error(w, "not found", http.StatusNotFound)
+	default:
+		log.Warnf("shard server: %s %s: %v", r.Method, p, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (s *ShardServer) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// cleanShardPath returns the path relative to the root, which never climbs
+// out of the root
+func cleanShardPath(p string) (string, bool) {
+	if strings.ContainsAny(p, "\\\x00") {
+		return "", false
+	}
+	// cleaning a rooted path drops every leading ".."
+	p = strings.TrimPrefix(path.Clean("/"+p), "/")
+	if p == "" {
+		p = "."
+	}
+	return p, true
+}
+
+// serveUsage writes the usage of the file system holding the root
+func (s *ShardServer) serveUsage(w http.ResponseWriter) error {
+	used, free, err := s.local.Usage()
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(shardServerUsage{Used: used, Free: free})
+}
+
+// serveFile writes the file, or lists the directory
+func (s *ShardServer) serveFile(w http.ResponseWriter, r *http.Request, fullPath string) error {
+	file, err := os.Open(fullPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		w.Header().Set(shardServerDirHeader, "true")
+		if r.Method == http.MethodHead {
+			return nil
+		}
+		infos, err := localList(fullPath)
+		if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/json")
+		return json.NewEncoder(w).Encode(infos)
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), file)
+	return nil
+}
+
+// putFile writes the body into the file, which is left untouched if the
+// body is not received in full
+func (s *ShardServer) putFile(w http.ResponseWriter, r *http.Request, fullPath string) error {
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, shardServerMaxBody))
+	if err != nil {
+		return fmt.Errorf("failed to receive file: %v", err)
+	}
+	return writeFileAtomic(fullPath, data)
+}
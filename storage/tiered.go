@@ -0,0 +1,612 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// time a failed tier is skipped by reads
+	tierCooldown = 30 * time.Second
+	// max number of files copied to faster tiers at the same time
+	tierMaxBackfills = 4
+)
+
+// TierConfig is a child storage of a tiered storage
+type TierConfig struct {
+	Type string `json:"type"`
+	StorageConfig
+}
+
+type tier struct {
+	index  int
+	config *TierConfig
+	// nil until the tier is initialized
+	driver ContextDriver
+
+	mu        sync.Mutex
+	downUntil time.Time
+	// paths written or deleted while the tier was skipped or failed, which
+	// the tier may hold outdated and so serves no reads of until they are
+	// replayed, by the sequence of their last miss
+	stale     map[string]int
+	seq       int
+	replaying bool
+	// time a failed replay is retried
+	replayAt time.Time
+}
+
+// tierPath is the key of a path in the stale paths of a tier
+func tierPath(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+}
+
+// isStale tells whether the tier may hold an outdated version of the path
+func (t *tier) isStale(p string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.stale[tierPath(p)]
+	return ok
+}
+
+// miss records paths the tier missed a write or delete of
+func (t *tier) miss(paths ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stale == nil {
+		t.stale = make(map[string]int)
+	}
+	for _, p := range paths {
+		t.seq++
+		t.stale[tierPath(p)] = t.seq
+	}
+}
+
+// written records paths the tier is up to date with again
+func (t *tier) written(paths ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, p := range paths {
+		delete(t.stale, tierPath(p))
+	}
+}
+
+// replayed records a path replayed as of the sequence of its miss. A path
+// missed or written again meanwhile may have been replayed over a newer
+// version and is replayed again.
+func (t *tier) replayed(p string, seq int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stale[p] == seq {
+		delete(t.stale, p)
+		return
+	}
+	t.seq++
+	t.stale[p] = t.seq
+}
+
+// healthy tells whether the tier is initialized and not put aside. A tier
+// which failed to init is initialized again once its cooldown is over.
+func (t *tier) healthy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Now().Before(t.downUntil) {
+		return false
+	}
+	if t.driver == nil {
+		if err := t.init(); err != nil {
+			log.Warnf("tier %s fails, skip it for %v: %v", t.config.Type, tierCooldown, err)
+			t.downUntil = time.Now().Add(tierCooldown)
+			return false
+		}
+	}
+	return true
+}
+
+// init initializes a new driver of the tier, which is only used once its
+// initialization succeeds
+func (t *tier) init() error {
+	driver := DriverInitializers[t.config.Type]()
+	if err := driver.Init(&t.config.StorageConfig); err != nil {
+		return fmt.Errorf("failed to init tier %d: %v", t.index, err)
+	}
+	t.driver = WithContext(driver)
+	return nil
+}
+
+// fail puts the tier aside for a while, unless the error only tells a
+// missing file or capability
+func (t *tier) fail(err error) {
+	if err == nil || errors.Is(err, fs.ErrNotExist) || errors.Is(err, ErrUnsupported) || errors.Is(err, context.Canceled) {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Now().After(t.downUntil) {
+		log.Warnf("tier %s fails, skip it for %v: %v", t.config.Type, tierCooldown, err)
+	}
+	t.downUntil = time.Now().Add(tierCooldown)
+}
+
+// TieredDriver combines storages ordered from the fastest to the slowest,
+// such as a local cache backed by a remote. Writes go through to every
+// healthy tier, reads are served by the first healthy tier holding the
+// file. A file missing from faster tiers is copied back to them in the
+// background. The writes and deletes a tier misses are replayed to it in
+// the background once it is healthy again, the tier serving none of those
+// files meanwhile. They are kept in memory only.
+type TieredDriver struct {
+	tiers []*tier
+
+	mu          sync.Mutex
+	backfilling map[string]bool
+}
+
+func (d *TieredDriver) Init(s *StorageConfig) error {
+	if len(s.Tiers) == 0 {
+		return errors.New("tiered needs tiers")
+	}
+	var errs []error
+	for i := range s.Tiers {
+		tc := &s.Tiers[i]
+		if _, ok := DriverInitializers[tc.Type]; !ok {
+			return fmt.Errorf("unknown type of tier %d: %s", i, tc.Type)
+		}
+		t := &tier{index: i, config: tc}
+		if err := t.init(); err != nil {
+			// served by the other tiers until it is initialized again
+			log.Warnf("tier %s fails, skip it for %v: %v", tc.Type, tierCooldown, err)
+			t.downUntil = time.Now().Add(tierCooldown)
+			errs = append(errs, err)
+		}
+		d.tiers = append(d.tiers, t)
+	}
+	if len(errs) == len(d.tiers) {
+		return fmt.Errorf("failed to init all tiers: %v", errors.Join(errs...))
+	}
+	d.backfilling = make(map[string]bool)
+	return nil
+}
+
+// healthy tells whether the tier is healthy, replaying the writes and
+// deletes it missed if so
+func (d *TieredDriver) healthy(t *tier) bool {
+	if !t.healthy() {
+		return false
+	}
+	d.replay(t)
+	return true
+}
+
+// readFirst calls f on the healthy tiers in order until it succeeds. The
+// tiers before the one succeeding, which miss the file, are backfilled.
+func (d *TieredDriver) readFirst(path string, f func(t *tier) error) error {
+	var missing []*tier
+	var errs []error
+	for _, t := range d.tiers {
+		if !d.healthy(t) || t.isStale(path) {
+			continue
+		}
+		err := f(t)
+		if err == nil {
+			if len(missing) > 0 {
+				d.backfill(path, t, missing)
+			}
+			return nil
+		}
+		t.fail(err)
+		errs = append(errs, err)
+		if errors.Is(err, fs.ErrNotExist) {
+			missing = append(missing, t)
+		}
+	}
+	if len(errs) == 0 {
+		return errors.New("no healthy tier")
+	}
+	return errors.Join(errs...)
+}
+
+// backfill copies the file from a tier to the tiers missing it, unless the
+// file is being copied already or too many files are
+func (d *TieredDriver) backfill(p string, from *tier, to []*tier) {
+	d.mu.Lock()
+	if d.backfilling[p] || len(d.backfilling) >= tierMaxBackfills {
+		d.mu.Unlock()
+		return
+	}
+	d.backfilling[p] = true
+	d.mu.Unlock()
+
+	go func() {
+		defer func() {
+			d.mu.Lock()
+			delete(d.backfilling, p)
+			d.mu.Unlock()
+		}()
+
+		ctx := context.Background()
+		rc, err := from.driver.ReadStreamContext(ctx, p, 0, math.MaxInt64)
+		if err != nil {
+			log.Warnf("failed to backfill %s: %v", p, err)
+			return
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			log.Warnf("failed to backfill %s: %v", p, err)
+			return
+		}
+
+		for _, t := range to {
+			if err := copyTo(ctx, t, p, data); err != nil {
+				t.fail(err)
+				log.Warnf("failed to backfill %s to tier %s: %v", p, t.config.Type, err)
+				continue
+			}
+			log.Debugf("- backfill %s to tier %s", p, t.config.Type)
+		}
+	}()
+}
+
+// copyTo creates the file on the tier along with its directory
+func copyTo(ctx context.Context, t *tier, p string, data []byte) error {
+	err := t.driver.MkdirContext(ctx, path.Dir(strings.ReplaceAll(p, "\\", "/")))
+	if err == nil {
+		err = t.driver.CreateContext(ctx, p, data)
+	}
+	return err
+}
+
+// replay brings the paths the tier missed up to date in the background,
+// copying them from the other tiers or deleting them when no tier holds
+// them anymore
+func (d *TieredDriver) replay(t *tier) {
+	t.mu.Lock()
+	if t.replaying || len(t.stale) == 0 || time.Now().Before(t.replayAt) {
+		t.mu.Unlock()
+		return
+	}
+	t.replaying = true
+	pending := make(map[string]int, len(t.stale))
+	for p, seq := range t.stale {
+		pending[p] = seq
+	}
+	t.mu.Unlock()
+
+	go func() {
+		defer func() {
+			t.mu.Lock()
+			t.replaying = false
+			t.mu.Unlock()
+		}()
+
+		ctx := context.Background()
+		for p, seq := range pending {
+			if err := d.restore(ctx, t, p); err != nil {
+				log.Warnf("failed to replay %s to tier %s, retry in %v: %v", p, t.config.Type, tierCooldown, err)
+				t.mu.Lock()
+				t.replayAt = time.Now().Add(tierCooldown)
+				t.mu.Unlock()
+				return
+			}
+			log.Debugf("- replay %s to tier %s", p, t.config.Type)
+			t.replayed(p, seq)
+		}
+	}()
+}
+
+// restore copies the file to the tier from the first other tier holding it,
+// or deletes it from the tier when every other tier misses it
+func (d *TieredDriver) restore(ctx context.Context, to *tier, p string) error {
+	var errs []error
+	checked := false
+	for _, t := range d.tiers {
+		if t == to || !t.healthy() || t.isStale(p) {
+			continue
+		}
+		checked = true
+		rc, err := t.driver.ReadStreamContext(ctx, p, 0, math.MaxInt64)
+		if err == nil {
+			var data []byte
+			data, err = io.ReadAll(rc)
+			rc.Close()
+			if err == nil {
+				err = copyTo(ctx, to, p, data)
+				to.fail(err)
+				return err
+			}
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			t.fail(err)
+			errs = append(errs, err)
+		}
+	}
+	if !checked {
+		return errors.New("no healthy tier to replay from")
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	err := to.driver.DeleteContext(ctx, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	to.fail(err)
+	return err
+}
+
+// writeAll calls f on every healthy tier in parallel, failing if any of
+// them fails or none is healthy. The tiers skipped or failing miss the
+// paths written until they are replayed. It returns the number of tiers
+// written.
+func (d *TieredDriver) writeAll(paths []string, f func(t *tier) error) (int, error) {
+	var tiers []*tier
+	for _, t := range d.tiers {
+		if d.healthy(t) {
+			tiers = append(tiers, t)
+		} else {
+			t.miss(paths...)
+		}
+	}
+	if len(tiers) == 0 {
+		return 0, errors.New("no healthy tier")
+	}
+
+	errs := make([]error, len(tiers))
+	var wg sync.WaitGroup
+	for i, t := range tiers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = f(t)
+			t.fail(errs[i])
+			if errs[i] != nil {
+				t.miss(paths...)
+			} else {
+				t.written(paths...)
+			}
+		}()
+	}
+	wg.Wait()
+	return len(tiers), errors.Join(errs...)
+}
+
+func (d *TieredDriver) Read(path string, offset int64, data []byte) (int, error) {
+	return d.ReadContext(context.Background(), path, offset, data)
+}
+
+func (d *TieredDriver) ReadContext(ctx context.Context, path string, offset int64, data []byte) (int, error) {
+	var n int
+	err := d.readFirst(path, func(t *tier) error {
+		var err error
+		n, err = t.driver.ReadContext(ctx, path, offset, data)
+		return err
+	})
+	return n, err
+}
+
+func (d *TieredDriver) ReadStream(path string, offset int64, length int64) (io.ReadCloser, error) {
+	return d.ReadStreamContext(context.Background(), path, offset, length)
+}
+
+func (d *TieredDriver) ReadStreamContext(ctx context.Context, path string, offset int64, length int64) (io.ReadCloser, error) {
+	var rc io.ReadCloser
+	err := d.readFirst(path, func(t *tier) error {
+		var err error
+		rc, err = t.driver.ReadStreamContext(ctx, path, offset, length)
+		return err
+	})
+	return rc, err
+}
+
+// Create creates the file on every healthy tier
+func (d *TieredDriver) Create(path string, data []byte) error {
+	return d.CreateContext(context.Background(), path, data)
+}
+
+func (d *TieredDriver) CreateContext(ctx context.Context, path string, data []byte) error {
+	_, err := d.writeAll([]string{path}, func(t *tier) error {
+		return t.driver.CreateContext(ctx, path, data)
+	})
+	return err
+}
+
+// Find checks if a file or directory exists on any healthy tier
+func (d *TieredDriver) Find(path string) error {
+	return d.FindContext(context.Background(), path)
+}
+
+func (d *TieredDriver) FindContext(ctx context.Context, path string) error {
+	var errs []error
+	for _, t := range d.tiers {
+		if !d.healthy(t) || t.isStale(path) {
+			continue
+		}
+		err := t.driver.FindContext(ctx, path)
+		if err == nil {
+			return nil
+		}
+		t.fail(err)
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errors.New("no healthy tier")
+	}
+	return errors.Join(errs...)
+}
+
+// Delete deletes the file from every healthy tier, a tier missing the file
+// is not an error unless all of them miss it
+func (d *TieredDriver) Delete(path string) error {
+	return d.DeleteContext(context.Background(), path)
+}
+
+func (d *TieredDriver) DeleteContext(ctx context.Context, path string) error {
+	var mu sync.Mutex
+	missing := 0
+	written, err := d.writeAll([]string{path}, func(t *tier) error {
+		err := t.driver.DeleteContext(ctx, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			mu.Lock()
+			missing++
+			mu.Unlock()
+			return nil
+		}
+		return err
+	})
+	if err == nil && missing == written {
+		return fmt.Errorf("%w: %s", fs.ErrNotExist, path)
+	}
+	return err
+}
+
+func (d *TieredDriver) Mkdir(path string) error {
+	return d.MkdirContext(context.Background(), path)
+}
+
+// MkdirContext creates the directory on every healthy tier, it succeeds when
+// any tier succeeds so the storage stays readable while a tier is down
+func (d *TieredDriver) MkdirContext(ctx context.Context, path string) error {
+	var mu sync.Mutex
+	created := 0
+	_, err := d.writeAll(nil, func(t *tier) error {
+		err := t.driver.MkdirContext(ctx, path)
+		if err == nil {
+			mu.Lock()
+			created++
+			mu.Unlock()
+		}
+		return err
+	})
+	if created > 0 {
+		return nil
+	}
+	return err
+}
+
+// Stat describes a file of the first healthy tier holding it
+func (d *TieredDriver) Stat(path string) (FileInfo, error) {
+	var info FileInfo
+	err := d.firstTier(path, func(t *tier) error {
+		var err error
+		info, err = Stat(t.driver, path)
+		return err
+	})
+	return info, err
+}
+
+// List enumerates a directory on every healthy tier, as faster tiers may
+// miss files and slower ones may miss failed writes
+func (d *TieredDriver) List(dir string) ([]FileInfo, error) {
+	var infos []FileInfo
+	seen := make(map[string]bool)
+	listed := false
+	var errs []error
+	for _, t := range d.tiers {
+		if !d.healthy(t) {
+			continue
+		}
+		tierInfos, err := List(t.driver, dir)
+		if err != nil {
+			t.fail(err)
+			errs = append(errs, err)
+			continue
+		}
+		listed = true
+		for _, info := range tierInfos {
+			if t.isStale(path.Join(dir, info.Name)) {
+				continue
+			}
+			if !seen[info.Name] {
+				seen[info.Name] = true
+				infos = append(infos, info)
+			}
+		}
+	}
+	if !listed {
+		if len(errs) == 0 {
+			return nil, errors.New("no healthy tier")
+		}
+		return nil, errors.Join(errs...)
+	}
+	return infos, nil
+}
+
+// firstTier calls f on the healthy tiers up to date with the path in order
+// until it succeeds
+func (d *TieredDriver) firstTier(path string, f func(t *tier) error) error {
+	var errs []error
+	for _, t := range d.tiers {
+		if !d.healthy(t) || t.isStale(path) {
+			continue
+		}
+		err := f(t)
+		if err == nil {
+			return nil
+		}
+		t.fail(err)
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return errors.New("no healthy tier")
+	}
+	return errors.Join(errs...)
+}
+
+// Rename renames the file on every healthy tier, a tier missing the file is
+// not an error unless all of them miss it
+func (d *TieredDriver) Rename(src, dst string) error {
+	var mu sync.Mutex
+	missing := 0
+	written, err := d.writeAll([]string{src, dst}, func(t *tier) error {
+		err := Rename(t.driver, src, dst)
+		if errors.Is(err, fs.ErrNotExist) {
+			mu.Lock()
+			missing++
+			mu.Unlock()
+			return nil
+		}
+		return err
+	})
+	if err == nil && missing == written {
+		return fmt.Errorf("%w: %s", fs.ErrNotExist, src)
+	}
+	return err
+}
+
+// Usage reports the healthy tier of the least free space, as every tier
+// holds every file
+func (d *TieredDriver) Usage() (used, free int64, err error) {
+	used, free = -1, -1
+	var errs []error
+	for _, t := range d.tiers {
+		if !t.healthy() {
+			errs = append(errs, fmt.Errorf("tier %d is unhealthy", t.index))
+			continue
+		}
+		u, f, err := Usage(t.driver)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if f >= 0 && (free < 0 || f < free) {
+			used, free = u, f
+		} else if free < 0 && u > used {
+			used = u
+		}
+	}
+	if len(errs) == len(d.tiers) {
+		return -1, -1, errors.Join(errs...)
+	}
+	return used, free, nil
+}
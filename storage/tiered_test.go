@@ -0,0 +1,77 @@
+package storage
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newTestTiered returns a tiered driver of two local tiers and their roots
+func newTestTiered(t *testing.T) (*TieredDriver, []string) {
+	t.Helper()
+	roots := []string{t.TempDir(), t.TempDir()}
+	s := &StorageConfig{}
+	for _, root := range roots {
+		s.Tiers = append(s.Tiers, TierConfig{Type: "local", StorageConfig: StorageConfig{Path: root}})
+	}
+	d := &TieredDriver{}
+	if err := d.Init(s); err != nil {
+		t.Fatal(err)
+	}
+	return d, roots
+}
+
+func TestTieredReplaysMissedWrites(t *testing.T) {
+	d, roots := newTestTiered(t)
+	for _, p := range []string{"a", "b"} {
+		if err := d.Create(p, []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the fast tier is down while a is replaced and b is deleted
+	cache := d.tiers[0]
+	cache.mu.Lock()
+	cache.downUntil = time.Now().Add(time.Hour)
+	cache.mu.Unlock()
+	if err := d.Create("a", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("b"); err != nil {
+		t.Fatal(err)
+	}
+	cache.mu.Lock()
+	cache.downUntil = time.Time{}
+	cache.mu.Unlock()
+
+	// the outdated files of the fast tier are not served
+	data := make([]byte, 3)
+	if _, err := d.Read("a", 0, data); err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "new" {
+		t.Fatalf("read %q of a, want %q", data, "new")
+	}
+	if err := d.Find("b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("find of deleted b: %v, want fs.ErrNotExist", err)
+	}
+
+	// and are replayed to it
+	deadline := time.Now().Add(5 * time.Second)
+	for cache.isStale("a") || cache.isStale("b") {
+		if time.Now().After(deadline) {
+			t.Fatal("missed writes are not replayed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	got, err := os.ReadFile(filepath.Join(roots[0], "a"))
+	if err != nil || string(got) != "new" {
+		t.Fatalf("fast tier holds %q of a (%v), want %q", got, err, "new")
+	}
+	if _, err := os.Stat(filepath.Join(roots[0], "b")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("fast tier holds deleted b: %v", err)
+	}
+}
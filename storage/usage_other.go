@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import "fmt"
+
+// Usage is unknown on this platform
+func (d *LocalDriver) Usage() (used, free int64, err error) {
+	return -1, -1, fmt.Errorf("usage: %w", ErrUnsupported)
+}
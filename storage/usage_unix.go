@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+
+package storage
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Usage reports the usage of the file system holding the base path
+func (d *LocalDriver) Usage() (used, free int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(d.basePath, &st); err != nil {
+		return -1, -1, fmt.Errorf("failed to statfs: %v", err)
+	}
+	bsize := uint64(st.Bsize)
+	used = int64((uint64(st.Blocks) - uint64(st.Bfree)) * bsize)
+	free = int64(uint64(st.Bavail) * bsize)
+	return used, free, nil
+}
@@ -1,22 +1,46 @@
 package storage
 
 import (
+	"bytes"
+	"context"
+	"encoding/xml"
 	"fmt"
 	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	pathpkg "path"
+	"strconv"
+	"strings"
 
-	log "github.com/sirupsen/logrus"
 	"github.com/studio-b12/gowebdav"
 )
 
 // WebDAVDriver stores the client for interacting with the WebDAV server
 type WebDAVDriver struct {
 	client *gowebdav.Client
+	// shared with the client for the requests of the driver
+	root    string
+	auth    gowebdav.Authorizer
+	headers http.Header
+	http    *http.Client
 }
 
 // Init initializes the WebDAV storage driver by setting up the client and verifying connection
 func (d *WebDAVDriver) Init(s *StorageConfig) error {
-	d.client = gowebdav.NewClient(s.Path, s.Username, s.Password)
-	d.client.SetHeader("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0.0.0 Safari/537.36 Edg/128.0.0.0")
+	d.root = gowebdav.FixSlash(s.Path)
+	d.auth = gowebdav.NewAutoAuth(s.Username, s.Password)
+	d.headers = http.Header{}
+	d.headers.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/128.0.0.0 Safari/537.36 Edg/128.0.0.0")
+	d.http = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+
+	d.client = gowebdav.NewAuthClient(s.Path, d.auth)
+	d.client.SetTransport(d.http.Transport)
+	for k, values := range d.headers {
+		for _, v := range values {
+			d.client.SetHeader(k, v)
+		}
+	}
 	err := d.client.Connect()
 	if err != nil {
 		return fmt.Errorf("failed to connect to WebDAV server: %v", err)
@@ -24,85 +48,332 @@ func (d *WebDAVDriver) Init(s *StorageConfig) error {
 	return nil
 }
 
-// Read reads data from a file at a specific offset
-func (d *WebDAVDriver) ReadStream(path string, offset int64, length int64) (io.ReadCloser, error) {
-	fullPath := "/" + path
-	rc, err := d.client.ReadStreamRange(fullPath, int64(offset), length)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file from WebDAV: %v", err)
-	}
+// the operations of shards are sent as requests of the driver, which a
+// context cancels, as the client lacks contexts
 
-	return rc, nil
+func (d *WebDAVDriver) Read(path string, offset int64, data []byte) (int, error) {
+	return d.ReadContext(context.Background(), path, offset, data)
 }
 
-func (d *WebDAVDriver) Read(path string, offset int64, data []byte) (int, error) {
-	fullPath := "/" + path
-	rc, err := d.client.ReadStreamRange(fullPath, int64(offset), int64(len(data)))
+func (d *WebDAVDriver) ReadContext(ctx context.Context, path string, offset int64, data []byte) (int, error) {
+	rc, err := d.ReadStreamContext(ctx, path, offset, int64(len(data)))
 	if err != nil {
-		return 0, fmt.Errorf("failed to read file from WebDAV: %v", err)
+		return 0, err
 	}
+	defer rc.Close()
 
 	n, err := io.ReadFull(rc, data)
-
 	if err != nil {
 		return 0, fmt.Errorf("failed to read file from WebDAV: %v", err)
 	}
 	return n, nil
-	// content, err := d.client.Read(fullPath)
-	// if err != nil {
-	// 	return 0, fmt.Errorf("failed to read file from WebDAV: %v", err)
-	// }
+}
+
+func (d *WebDAVDriver) ReadStream(path string, offset int64, length int64) (io.ReadCloser, error) {
+	return d.ReadStreamContext(context.Background(), path, offset, length)
+}
+
+// ReadStreamContext reads a range of the file, skipping to the offset when
+// the server ignores ranges
+func (d *WebDAVDriver) ReadStreamContext(ctx context.Context, path string, offset int64, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if length > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", offset, offset+length-1))
+	} else {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.do(ctx, http.MethodGet, "/"+path, nil, header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file from WebDAV: %v", err)
+	}
 
-	// n := copy(data, content[offset:])
-	// return n, nil
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		return resp.Body, nil
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, fmt.Errorf("failed to read file from WebDAV: %v", err)
+		}
+		if length > 0 {
+			return struct {
+				io.Reader
+				io.Closer
+			}{io.LimitReader(resp.Body, length), resp.Body}, nil
+		}
+		return resp.Body, nil
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("failed to read file from WebDAV: %w", webdavStatus(resp))
 }
 
-// Create creates a new file, returns error if file already exists
+// Create uploads the file under a temporary name and moves it into place,
+// replacing an existing one
 func (d *WebDAVDriver) Create(path string, data []byte) error {
-	fullPath := "/" + path
+	return d.CreateContext(context.Background(), path, data)
+}
 
-	err := d.Find(path)
+func (d *WebDAVDriver) CreateContext(ctx context.Context, path string, data []byte) error {
+	err := renameInto("/"+path,
+		func(tmp string) error { return d.put(ctx, tmp, data) },
+		func(tmp, p string) error { return d.move(ctx, tmp, p) },
+		func(tmp string) error {
+			// a temporary file left by a cancelled upload is swept later
+			if ctx.Err() != nil {
+				return nil
+			}
+			return d.DeleteContext(ctx, tmp)
+		})
+	if err != nil {
+		return fmt.Errorf("failed to create file on WebDAV: %v", err)
+	}
+	return nil
+}
 
-	if err == nil {
-		// return fmt.Errorf("file %s already exists", path)
-		log.Warnf("file %s has existed, will be overwritten", path)
+// put uploads the file, creating its parent directories when missing
+func (d *WebDAVDriver) put(ctx context.Context, p string, data []byte) error {
+	for retry := false; ; retry = true {
+		resp, err := d.do(ctx, http.MethodPut, p, data, nil)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK, http.StatusCreated, http.StatusNoContent:
+			return nil
+		case http.StatusNotFound, http.StatusConflict:
+			if !retry {
+				if err := d.MkdirContext(ctx, pathpkg.Dir(p)); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		return webdavStatus(resp)
 	}
+}
 
-	err = d.client.Write(fullPath, data, 0644)
+// move renames the file, replacing the destination
+func (d *WebDAVDriver) move(ctx context.Context, src, dst string) error {
+	header := http.Header{
+		"Destination": {gowebdav.PathEscape(gowebdav.Join(d.root, dst))},
+		"Overwrite":   {"T"},
+	}
+	resp, err := d.do(ctx, "MOVE", src, nil, header)
 	if err != nil {
-		return fmt.Errorf("failed to create file on WebDAV: %v", err)
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		return webdavStatus(resp)
 	}
 	return nil
 }
 
 // Find checks if a file or directory exists
 func (d *WebDAVDriver) Find(path string) error {
-	fullPath := "/" + path
-	_, err := d.client.Stat(fullPath)
+	return d.FindContext(context.Background(), path)
+}
 
+func (d *WebDAVDriver) FindContext(ctx context.Context, path string) error {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/></d:prop></d:propfind>`
+	resp, err := d.do(ctx, "PROPFIND", "/"+path, []byte(body), http.Header{
+		"Depth":        {"0"},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	})
 	if err != nil {
 		return err
 	}
-
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return webdavStatus(resp)
+	}
 	return nil
 }
 
 // Delete deletes a file
 func (d *WebDAVDriver) Delete(path string) error {
-	fullPath := "/" + path
-	err := d.client.Remove(fullPath)
+	return d.DeleteContext(context.Background(), path)
+}
+
+func (d *WebDAVDriver) DeleteContext(ctx context.Context, path string) error {
+	p := path
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	resp, err := d.do(ctx, http.MethodDelete, p, nil, nil)
 	if err != nil {
 		return fmt.Errorf("failed to delete file from WebDAV: %v", err)
 	}
-	return nil
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+		return nil
+	}
+	return fmt.Errorf("failed to delete file from WebDAV: %v", webdavStatus(resp))
 }
 
 func (d *WebDAVDriver) Mkdir(path string) error {
-	fullPath := "/" + path
-	err := d.client.MkdirAll(fullPath, 0644)
-	// err := d.client.Mkdir(fullPath, 0644)
+	return d.MkdirContext(context.Background(), path)
+}
+
+// MkdirContext creates the directory along with its parents
+func (d *WebDAVDriver) MkdirContext(ctx context.Context, path string) error {
+	var sub string
+	for _, e := range strings.Split(path, "/") {
+		if e == "" {
+			continue
+		}
+		sub += "/" + e
+		resp, err := d.do(ctx, "MKCOL", sub+"/", nil, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create mkdir: %v", err)
+		}
+		resp.Body.Close()
+		// an existing directory is not allowed to be created
+		if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusMethodNotAllowed {
+			return fmt.Errorf("failed to create mkdir: %v", webdavStatus(resp))
+		}
+	}
+	return nil
+}
+
+// webdavStatus is the error of an unexpected response, fs.ErrNotExist for
+// a missing file
+func webdavStatus(resp *http.Response) error {
+	err := fmt.Errorf("%s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return err
+}
+
+// webdavError turns the error of a missing file into fs.ErrNotExist
+func webdavError(err error) error {
+	if gowebdav.IsErrNotFound(err) {
+		return fmt.Errorf("%w: %v", fs.ErrNotExist, err)
+	}
+	return err
+}
+
+// Stat describes a file or a directory
+func (d *WebDAVDriver) Stat(path string) (FileInfo, error) {
+	info, err := d.client.Stat("/" + path)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("failed to stat on WebDAV: %w", webdavError(err))
+	}
+	return webdavFileInfo(info), nil
+}
+
+// List returns the files and directories directly under dir
+func (d *WebDAVDriver) List(dir string) ([]FileInfo, error) {
+	infos, err := d.client.ReadDir("/" + dir)
 	if err != nil {
-		return fmt.Errorf("failed to create mkdir: %v", err)
+		return nil, fmt.Errorf("failed to list on WebDAV: %w", webdavError(err))
+	}
+	result := make([]FileInfo, 0, len(infos))
+	for _, info := range infos {
+		result = append(result, webdavFileInfo(info))
+	}
+	return result, nil
+}
+
+func webdavFileInfo(info os.FileInfo) FileInfo {
+	return FileInfo{
+		Name:    info.Name(),
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+	}
+}
+
+// Rename moves a file, replacing the destination
+func (d *WebDAVDriver) Rename(src, dst string) error {
+	err := d.client.Rename("/"+src, "/"+dst, true)
+	if err != nil {
+		return fmt.Errorf("failed to rename on WebDAV: %w", webdavError(err))
 	}
 	return nil
 }
+
+// Usage reads the quota properties of RFC 4331, which some servers lack
+func (d *WebDAVDriver) Usage() (used, free int64, err error) {
+	body := `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:quota-available-bytes/><d:quota-used-bytes/></d:prop></d:propfind>`
+	resp, err := d.do(context.Background(), "PROPFIND", "/", []byte(body), http.Header{
+		"Depth":        {"0"},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	})
+	if err != nil {
+		return -1, -1, fmt.Errorf("failed to get quota from WebDAV: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return -1, -1, fmt.Errorf("failed to get quota from WebDAV: %s", resp.Status)
+	}
+
+	// missing properties come in a propstat of their own
+	var result struct {
+		Propstats []struct {
+			Available string `xml:"prop>quota-available-bytes"`
+			Used      string `xml:"prop>quota-used-bytes"`
+		} `xml:"response>propstat"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return -1, -1, fmt.Errorf("bad quota from WebDAV: %v", err)
+	}
+	used, free = -1, -1
+	for _, p := range result.Propstats {
+		if n, err := strconv.ParseInt(strings.TrimSpace(p.Used), 10, 64); err == nil {
+			used = n
+		}
+		if n, err := strconv.ParseInt(strings.TrimSpace(p.Available), 10, 64); err == nil && n >= 0 {
+			free = n
+		}
+	}
+	if used < 0 && free < 0 {
+		return -1, -1, fmt.Errorf("usage: %w", ErrUnsupported)
+	}
+	return used, free, nil
+}
+
+// do sends a request for the path the way the client does, through its
+// transport, with its headers and authenticated by its authorizer, which
+// is cancelled once ctx is done
+func (d *WebDAVDriver) do(ctx context.Context, method, p string, body []byte, header http.Header) (*http.Response, error) {
+	auth, _ := d.auth.NewAuthenticator(nil)
+	defer auth.Close()
+
+	uri := gowebdav.PathEscape(gowebdav.Join(d.root, p))
+	for {
+		req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, values := range d.headers {
+			req.Header[k] = append(req.Header[k], values...)
+		}
+		for k, values := range header {
+			req.Header[k] = append(req.Header[k], values...)
+		}
+		if err := auth.Authorize(d.http, req, p); err != nil {
+			return nil, err
+		}
+
+		resp, err := d.http.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		redo, err := auth.Verify(d.http, resp, p)
+		if err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		if !redo {
+			return resp, nil
+		}
+		// authenticated in another way, send it again
+		resp.Body.Close()
+	}
+}
@@ -0,0 +1,166 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	pathpkg "path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeWebDAV serves the requests the driver sends, with a file stalling
+// every request on it until the request is cancelled
+type fakeWebDAV struct {
+	mu    sync.Mutex
+	files map[string][]byte
+	dirs  map[string]bool
+	stall string
+}
+
+func newFakeWebDAV(t *testing.T) (*fakeWebDAV, *WebDAVDriver) {
+	f := &fakeWebDAV{
+		files: make(map[string][]byte),
+		dirs:  map[string]bool{"/": true},
+		stall: "/stall",
+	}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+
+	d := &WebDAVDriver{}
+	if err := d.Init(&StorageConfig{Path: server.URL}); err != nil {
+		t.Fatal(err)
+	}
+	return f, d
+}
+
+func (f *fakeWebDAV) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.TrimSuffix(r.URL.Path, "/")
+	if p == "" {
+		p = "/"
+	}
+	if p == f.stall {
+		<-r.Context().Done()
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		data, ok := f.files[p]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		http.ServeContent(w, r, p, time.Time{}, bytes.NewReader(data))
+	case http.MethodPut:
+		if !f.dirs[pathpkg.Dir(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		data, _ := io.ReadAll(r.Body)
+		f.files[p] = data
+		w.WriteHeader(http.StatusCreated)
+	case "MOVE":
+		u, err := url.Parse(r.Header.Get("Destination"))
+		data, ok := f.files[p]
+		if err != nil || !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.files, p)
+		f.files[u.Path] = data
+		w.WriteHeader(http.StatusCreated)
+	case "MKCOL":
+		if f.dirs[p] {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !f.dirs[pathpkg.Dir(p)] {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		f.dirs[p] = true
+		w.WriteHeader(http.StatusCreated)
+	case "PROPFIND":
+		if _, ok := f.files[p]; !ok && !f.dirs[p] {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusMultiStatus)
+		io.WriteString(w, `<?xml version="1.0"?><d:multistatus xmlns:d="DAV:"/>`)
+	case http.MethodDelete:
+		if _, ok := f.files[p]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(f.files, p)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestWebDAVRoundTrip(t *testing.T) {
+	f, d := newFakeWebDAV(t)
+
+	data := []byte("0123456789")
+	if err := d.Create("a/b/shard", data); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.files) != 1 || !bytes.Equal(f.files["/a/b/shard"], data) {
+		t.Fatalf("unexpected files after create: %v", f.files)
+	}
+
+	buf := make([]byte, 4)
+	if _, err := d.Read("a/b/shard", 3, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "3456" {
+		t.Fatalf("read %q, want %q", buf, "3456")
+	}
+
+	if err := d.Find("a/b/shard"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete("a/b/shard"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Find("a/b/shard"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("find of a deleted file: %v, want fs.ErrNotExist", err)
+	}
+	if _, err := d.Read("a/b/shard", 0, buf); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("read of a deleted file: %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestWebDAVContextCancelsRequest(t *testing.T) {
+	_, d := newFakeWebDAV(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := d.ReadContext(ctx, "stall", 0, make([]byte, 4))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("read of a stalled file succeeded")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read was not cancelled with its context")
+	}
+}
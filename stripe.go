@@ -0,0 +1,139 @@
+package rnas
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// stripeLayout describes where a stripe lives inside an object
+type stripeLayout struct {
+	index     int
+	offset    size_t // offset of the first data byte of the stripe in the object
+	size      size_t // real data bytes held by the stripe, padding excluded
+	shardSize int
+}
+
+// shardSize returns the size of every shard of the next stripe when
+// left bytes of the object are still to be striped
+func (sc *StripeConfig) shardSize(left size_t) int {
+	return max(min(sc.StripeDepth, int(left/size_t(sc.K))), sc.MinDepth, 1)
+}
+
+// layout computes the stripes of the object in the same way Put cut them,
+// a chunked object has a stripe per chunk
+func (fs *FileStripe) layout() []stripeLayout {
+	var stripes []stripeLayout
+	if fs.Chunked {
+		for _, chunk := range fs.chunks {
+			stripes = append(stripes, chunk.stripeLayout)
+		}
+		return stripes
+	}
+	for i := size_t(0); i < fs.Size; {
+		left := fs.Size - i
+		shardSize := fs.shardSize(left)
+		stripes = append(stripes, stripeLayout{
+			index:     len(stripes),
+			offset:    i,
+			size:      min(left, size_t(shardSize*fs.K)),
+			shardSize: shardSize,
+		})
+		i += size_t(shardSize) * size_t(fs.K)
+	}
+	return stripes
+}
+
+// maxShardsPerServer is the max number of shards of one stripe that
+// a single server may hold without breaking the tolerance
+func (c *Config) maxShardsPerServer() int {
+	return c.M / c.Tolerance
+}
+
+// loadShard retrieves a shard from its server, verifies and decrypts it.
+// A shard read after ctx is done is dropped. The shard may be given back
+// to shardBuffers once it is used.
+func (c *Config) loadShard(ctx context.Context, fs *FileStripe, shard *Shard, shardSize int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if shard.missing {
+		return nil, fmt.Errorf("shard %d failed to be stored on server[%s]", shard.shardIndex, shard.serverID)
+	}
+	server, ok := c.maps[shard.serverID]
+	if !ok || !server.reachable {
+		return nil, fmt.Errorf("server[%s] is unavailable", shard.serverID)
+	}
+
+	data := c.shardBuffers.get(fs.storedShardSize(shardSize))
+	_, err := server.GetShard(ctx, shard, data)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if hashMD5(data) != shard.shardHashname {
+		return nil, c.corruptShard(fs, shard, fmt.Errorf("bad data when verifying hash %s", shard.shardHashname))
+	}
+
+	plain, err := fs.openShard(data)
+	if err != nil {
+		return nil, c.corruptShard(fs, shard, fmt.Errorf("failed to decrypt: %v", err))
+	}
+	if fs.cipher != nil {
+		c.shardBuffers.put(data)
+	}
+	return plain, nil
+}
+
+// fetchStripe retrieves the given shards of a stripe in parallel.
+// The slot of a shard that is skipped, unreachable or fails
+// verification is left nil.
+func (c *Config) fetchStripe(fs *FileStripe, shards []Shard, shardSize int, skip func(*Shard) bool) [][]byte {
+	data := make([][]byte, len(shards))
+
+	var wg sync.WaitGroup
+	for j := range shards {
+		shard := &shards[j]
+		if skip != nil && skip(shard) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(j int, shard *Shard) {
+			defer wg.Done()
+			buf, err := c.loadShard(context.Background(), fs, shard, shardSize)
+			if err != nil {
+				log.Warnf("retrieve shard %d error: %v", shard.shardIndex, err)
+				return
+			}
+			data[j] = buf
+		}(j, shard)
+	}
+	wg.Wait()
+
+	return data
+}
+
+// pickServer chooses a reachable server that can take one more shard of a
+// stripe whose current placement is given by counts. Servers with fewer
+// shards of the stripe are preferred, then the faster ones.
+func (c *Config) pickServer(counts map[string]int, exclude func(*Server) bool) *Server {
+	var picked *Server
+	for _, server := range c.Servers {
+		if !server.reachable || (exclude != nil && exclude(server)) {
+			continue
+		}
+		if counts[server.Id] >= c.maxShardsPerServer() {
+			continue
+		}
+		if picked == nil || counts[server.Id] < counts[picked.Id] {
+			picked = server
+		}
+	}
+	return picked
+}
@@ -0,0 +1,72 @@
+package rnas
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/yztz/rnas/storage"
+)
+
+// SweepTemp deletes the temporary files left on the servers by interrupted
+// writes, once they are older than age so that writes in progress are
+// spared. It returns the number of files deleted.
+func (c *Config) SweepTemp(age time.Duration) (int, error) {
+	log.Infof("Sweep temporary files older than %v", age)
+
+	removed := 0
+	var errs []error
+	for _, server := range c.Servers {
+		if !server.reachable {
+			errs = append(errs, fmt.Errorf("server[%s] is unreachable", server.Id))
+			continue
+		}
+		n, err := server.sweepTemp(c.Name, time.Now().Add(-age))
+		removed += n
+		if errors.Is(err, storage.ErrUnsupported) {
+			log.Warnf("- server[%s] cannot list files, skipped", server.Id)
+			continue
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("server[%s]: %w", server.Id, err))
+		}
+	}
+	log.Infof("%d temporary files are deleted", removed)
+	return removed, errors.Join(errs...)
+}
+
+// sweepTemp deletes the temporary files under dir modified before the
+// deadline, walking down the directories
+func (server *Server) sweepTemp(dir string, deadline time.Time) (int, error) {
+	infos, err := storage.List(server.driver, dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	var errs []error
+	for _, info := range infos {
+		p := path.Join(dir, info.Name)
+		if info.IsDir {
+			n, err := server.sweepTemp(p, deadline)
+			removed += n
+			if err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		// a file without modification time is old enough
+		if !storage.IsTemp(info.Name) || info.ModTime.After(deadline) {
+			continue
+		}
+		if err := server.driver.Delete(p); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		log.Debugf("- delete %s from server[%s]", p, server.Id)
+		removed++
+	}
+	return removed, errors.Join(errs...)
+}
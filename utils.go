@@ -3,6 +3,7 @@ package rnas
 import (
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 )
 
@@ -19,4 +20,10 @@ func hashMD5(data []byte) string {
 	return hex.EncodeToString(hash[:]) // 将结果转成十六进制字符串
 }
 
+// hashSHA256 returns the content hash of deduplicated data
+func hashSHA256(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
 